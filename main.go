@@ -1,41 +1,507 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Masterminds/squirrel"
+	"github.com/fsnotify/fsnotify"
 	"github.com/gin-gonic/gin"
-	_ "github.com/lib/pq"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgconn/stmtcache"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-const (
-	host     = "localhost"
-	port     = 5432
-	username = "postgres"
-	password = "postgres"
-	dbname   = "OfficeManagement"
-)
+// envPrefix namespaces the environment variables read by loadConfig, e.g.
+// OFFICEAPI_DATABASE_PASSWORD for database.password.
+const envPrefix = "OFFICEAPI"
+
+// Config holds the server settings. Values are resolved with the precedence
+// flags > environment > config.<profile>.yaml > config.yaml > defaults.
+type Config struct {
+	Profile      string             `mapstructure:"profile"`
+	Server       ServerConfig       `mapstructure:"server"`
+	Database     DatabaseConfig     `mapstructure:"database"`
+	Auth         AuthConfig         `mapstructure:"auth"`
+	Log          LogConfig          `mapstructure:"log"`
+	RateLimit    RateLimitConfig    `mapstructure:"rate_limit"`
+	CORS         CORSConfig         `mapstructure:"cors"`
+	QueryTimeout QueryTimeoutConfig `mapstructure:"query_timeout"`
+	Features     map[string]bool    `mapstructure:"features"`
+
+	// Files lists the config files that were read, for the reload watcher
+	Files []string `mapstructure:"-"`
+}
+
+// ServerConfig sets the API port and the separate address /metrics is served on,
+// which should only be reachable by the monitoring system. An empty MetricsAddress
+// disables metrics.
+type ServerConfig struct {
+	Port           int    `mapstructure:"port"`
+	MetricsAddress string `mapstructure:"metrics_address"`
+}
+
+type DatabaseConfig struct {
+	Host     string     `mapstructure:"host"`
+	Port     int        `mapstructure:"port"`
+	User     string     `mapstructure:"user"`
+	Password string     `mapstructure:"password"`
+	Name     string     `mapstructure:"name"`
+	SSLMode  string     `mapstructure:"sslmode"`
+	Pool     PoolConfig `mapstructure:"pool"`
+}
+
+// PoolConfig sizes the connection pool. StatementCacheMode is "prepare" to keep
+// server-side prepared statements, "describe" to cache only statement descriptions
+// (safe behind PgBouncer in transaction mode) or "off".
+type PoolConfig struct {
+	MaxConns               int32         `mapstructure:"max_conns"`
+	MinConns               int32         `mapstructure:"min_conns"`
+	MaxConnLifetime        time.Duration `mapstructure:"max_conn_lifetime"`
+	MaxConnIdleTime        time.Duration `mapstructure:"max_conn_idle_time"`
+	HealthCheckPeriod      time.Duration `mapstructure:"health_check_period"`
+	ConnectTimeout         time.Duration `mapstructure:"connect_timeout"`
+	StatementCacheMode     string        `mapstructure:"statement_cache_mode"`
+	StatementCacheCapacity int           `mapstructure:"statement_cache_capacity"`
+}
+
+// AuthConfig configures bearer token verification. At least one of HS256Secret and
+// JWKSFile must be set.
+type AuthConfig struct {
+	HS256Secret string `mapstructure:"hs256_secret"`
+	JWKSFile    string `mapstructure:"jwks_file"`
+	Issuer      string `mapstructure:"issuer"`
+	Audience    string `mapstructure:"audience"`
+}
+
+// The settings below can change while the server runs; see watchConfig.
+
+// LogConfig sets the log level, which can change at runtime, and where logs go, which
+// cannot. Format is "json", or "console" to also pretty-print to stderr during
+// development; Stdout copies the JSON log to stdout for container deployments.
+type LogConfig struct {
+	Level  string        `mapstructure:"level"`
+	Format string        `mapstructure:"format"`
+	Stdout bool          `mapstructure:"stdout"`
+	File   LogFileConfig `mapstructure:"file"`
+}
+
+// LogFileConfig rotates the log file once it reaches MaxSizeMB or every RotateEvery,
+// whichever comes first, keeping MaxBackups old files for up to MaxAgeDays.
+type LogFileConfig struct {
+	Path        string        `mapstructure:"path"`
+	MaxSizeMB   int           `mapstructure:"max_size_mb"`
+	RotateEvery time.Duration `mapstructure:"rotate_every"`
+	MaxBackups  int           `mapstructure:"max_backups"`
+	MaxAgeDays  int           `mapstructure:"max_age_days"`
+	Compress    bool          `mapstructure:"compress"`
+}
+
+// RateLimitConfig limits each authenticated caller to RequestsPerSecond with bursts of
+// up to Burst requests. IPRequestsPerSecond and IPBurst limit each client address before
+// authentication, so failed logins and key guessing are capped too. A zero rate
+// disables that limit.
+type RateLimitConfig struct {
+	RequestsPerSecond   float64 `mapstructure:"requests_per_second"`
+	Burst               int     `mapstructure:"burst"`
+	IPRequestsPerSecond float64 `mapstructure:"ip_requests_per_second"`
+	IPBurst             int     `mapstructure:"ip_burst"`
+}
+
+type CORSConfig struct {
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+}
+
+// QueryTimeoutConfig bounds the database work of a request. Routes overrides Default
+// for route templates such as "GET /offices"; zero means no limit.
+type QueryTimeoutConfig struct {
+	Default time.Duration            `mapstructure:"default"`
+	Routes  map[string]time.Duration `mapstructure:"routes"`
+}
+
+func (f LogFileConfig) validate() error {
+	switch {
+	case f.Path == "":
+		return errors.New("log.file.path must be set")
+	case f.MaxSizeMB < 1:
+		return errors.New("log.file.max_size_mb must be at least 1")
+	case f.RotateEvery < 0 || f.MaxBackups < 0 || f.MaxAgeDays < 0:
+		return errors.New("log.file rotate_every, max_backups and max_age_days must not be negative")
+	}
+	return nil
+}
+
+func (p PoolConfig) validate() error {
+	switch {
+	case p.MaxConns < 1:
+		return errors.New("database.pool.max_conns must be at least 1")
+	case p.MinConns < 0 || p.MinConns > p.MaxConns:
+		return errors.New("database.pool.min_conns must be between 0 and database.pool.max_conns")
+	case p.MaxConnLifetime < 0 || p.MaxConnIdleTime < 0 || p.HealthCheckPeriod <= 0 || p.ConnectTimeout <= 0:
+		return errors.New("database.pool durations must not be negative and health_check_period and connect_timeout must be positive")
+	case p.StatementCacheCapacity < 0:
+		return errors.New("database.pool.statement_cache_capacity must not be negative")
+	}
+	if _, ok := statementCacheModes[p.StatementCacheMode]; !ok && p.StatementCacheMode != "off" {
+		return fmt.Errorf("invalid database.pool.statement_cache_mode %q: expected prepare, describe or off", p.StatementCacheMode)
+	}
+	return nil
+}
+
+var statementCacheModes = map[string]int{
+	"prepare":  stmtcache.ModePrepare,
+	"describe": stmtcache.ModeDescribe,
+}
+
+// newPool opens the pgx pool and checks that the database is reachable. Each new
+// connection, including those opened later by the pool, gets Pool.ConnectTimeout to
+// connect; the initial connect and ping together get the same allowance.
+func newPool(ctx context.Context, config DatabaseConfig) (*DB, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.Pool.ConnectTimeout)
+	defer cancel()
+
+	poolConfig, err := pgxpool.ParseConfig(config.DSN())
+	if err != nil {
+		return nil, err
+	}
+	poolConfig.MaxConns = config.Pool.MaxConns
+	poolConfig.MinConns = config.Pool.MinConns
+	poolConfig.MaxConnLifetime = config.Pool.MaxConnLifetime
+	poolConfig.MaxConnIdleTime = config.Pool.MaxConnIdleTime
+	poolConfig.HealthCheckPeriod = config.Pool.HealthCheckPeriod
+	poolConfig.ConnConfig.ConnectTimeout = config.Pool.ConnectTimeout
+	poolConfig.ConnConfig.Logger = queryLogger{}
+	poolConfig.ConnConfig.RuntimeParams["application_name"] = applicationName
+	poolConfig.BeforeAcquire = tagSession
+	poolConfig.ConnConfig.LogLevel = pgx.LogLevelError
+
+	// Without a statement cache every query is described on each use
+	mode, ok := statementCacheModes[config.Pool.StatementCacheMode]
+	if !ok || config.Pool.StatementCacheCapacity == 0 {
+		poolConfig.ConnConfig.BuildStatementCache = nil
+	} else {
+		capacity := config.Pool.StatementCacheCapacity
+		poolConfig.ConnConfig.BuildStatementCache = func(conn *pgconn.PgConn) stmtcache.Cache {
+			return stmtcache.New(conn, mode, capacity)
+		}
+	}
+
+	pool, err := pgxpool.ConnectConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &DB{Pool: pool}, nil
+}
+
+// DB is the connection pool used by the handlers. It records the latency of every
+// statement they run under the statement's query name.
+type DB struct {
+	*pgxpool.Pool
+}
+
+func (db *DB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	start := time.Now()
+	rows, err := db.Pool.Query(ctx, sql, args...)
+	return timeRows(sql, start, rows, err)
+}
+
+func (db *DB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	start := time.Now()
+	return &timedRow{Row: db.Pool.QueryRow(ctx, sql, args...), sql: sql, start: start}
+}
+
+func (db *DB) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	defer observeQuery(sql, time.Now())
+	return db.Pool.Exec(ctx, sql, args...)
+}
+
+func (db *DB) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &timedTx{Tx: tx}, nil
+}
+
+// timedTx records statement latency inside a transaction like DB does outside one.
+type timedTx struct {
+	pgx.Tx
+}
+
+func (tx *timedTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	start := time.Now()
+	rows, err := tx.Tx.Query(ctx, sql, args...)
+	return timeRows(sql, start, rows, err)
+}
+
+func (tx *timedTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	start := time.Now()
+	return &timedRow{Row: tx.Tx.QueryRow(ctx, sql, args...), sql: sql, start: start}
+}
+
+func (tx *timedTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	defer observeQuery(sql, time.Now())
+	return tx.Tx.Exec(ctx, sql, args...)
+}
+
+// timedRow stops the clock once the row has been read.
+type timedRow struct {
+	pgx.Row
+	sql   string
+	start time.Time
+}
+
+func (r *timedRow) Scan(dest ...interface{}) error {
+	defer observeQuery(r.sql, r.start)
+	return r.Row.Scan(dest...)
+}
+
+// timedRows stops the clock when the result set is closed, which every caller defers.
+type timedRows struct {
+	pgx.Rows
+	sql    string
+	start  time.Time
+	closed bool
+}
+
+func timeRows(sql string, start time.Time, rows pgx.Rows, err error) (pgx.Rows, error) {
+	if err != nil {
+		observeQuery(sql, start)
+		return rows, err
+	}
+	return &timedRows{Rows: rows, sql: sql, start: start}, nil
+}
+
+func (r *timedRows) Close() {
+	r.Rows.Close()
+	if !r.closed {
+		r.closed = true
+		observeQuery(r.sql, r.start)
+	}
+}
+
+func observeQuery(sql string, start time.Time) {
+	dbQueryDuration.WithLabelValues(queryName(sql)).Observe(time.Since(start).Seconds())
+}
+
+// DSN renders the connection string for the configured database.
+func (d DatabaseConfig) DSN() string {
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(d.User, d.Password),
+		Host:     fmt.Sprintf("%s:%d", d.Host, d.Port),
+		Path:     "/" + d.Name,
+		RawQuery: url.Values{"sslmode": {d.SSLMode}}.Encode(),
+	}
+	return dsn.String()
+}
+
+// requiredConfigKeys must resolve to a non-empty value from some source.
+var requiredConfigKeys = []string{
+	"server.port",
+	"database.host",
+	"database.port",
+	"database.user",
+	"database.password",
+	"database.name",
+}
+
+var configProfiles = map[string]bool{"dev": true, "staging": true, "prod": true}
+
+// loadConfig builds the configuration from command-line flags, OFFICEAPI_* environment
+// variables, config.yaml and the profile overlay config.<profile>.yaml.
+func loadConfig(args []string) (*Config, error) {
+	v := viper.New()
+
+	flags := pflag.NewFlagSet("office-api", pflag.ContinueOnError)
+	flags.String("config-dir", ".", "directory holding config.yaml and the profile overlays")
+	flags.String("profile", "", "configuration profile: dev, staging or prod (required)")
+	flags.Int("server.port", 5032, "port the HTTP server listens on")
+	flags.String("server.metrics_address", "127.0.0.1:9090", "address serving /metrics, kept off the API port; empty disables it")
+	flags.String("database.host", "", "PostgreSQL host")
+	flags.Int("database.port", 5432, "PostgreSQL port")
+	flags.String("database.user", "", "PostgreSQL user")
+	flags.String("database.password", "", "PostgreSQL password")
+	flags.String("database.name", "", "PostgreSQL database name")
+	flags.String("database.sslmode", "disable", "PostgreSQL sslmode")
+	flags.Int32("database.pool.max_conns", 10, "maximum open connections")
+	flags.Int32("database.pool.min_conns", 2, "connections kept open when idle")
+	flags.Duration("database.pool.max_conn_lifetime", time.Hour, "age after which a connection is replaced")
+	flags.Duration("database.pool.max_conn_idle_time", 30*time.Minute, "idle time after which a connection is closed")
+	flags.Duration("database.pool.health_check_period", time.Minute, "interval between idle connection health checks")
+	flags.Duration("database.pool.connect_timeout", 10*time.Second, "time allowed to open a connection")
+	flags.String("database.pool.statement_cache_mode", "prepare", "statement cache mode: prepare, describe or off")
+	flags.Int("database.pool.statement_cache_capacity", 512, "statements cached per connection")
+	flags.String("log.level", "info", "log level: debug, info, warn or error")
+	flags.String("log.format", "json", "log format: json or console")
+	flags.Bool("log.stdout", false, "also write the JSON log to stdout")
+	flags.String("log.file.path", "app.log", "log file, appended to on start")
+	flags.Int("log.file.max_size_mb", 100, "size at which the log file is rotated")
+	flags.Duration("log.file.rotate_every", 24*time.Hour, "interval at which the log file is rotated; 0 rotates on size only")
+	flags.Int("log.file.max_backups", 7, "rotated log files to keep; 0 keeps all")
+	flags.Int("log.file.max_age_days", 30, "days to keep rotated log files; 0 keeps them regardless of age")
+	flags.Bool("log.file.compress", true, "gzip rotated log files")
+	flags.Duration("query_timeout.default", 5*time.Second, "time allowed for the queries of one request")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Flags only override other sources when they are set explicitly, so binding them
+	// also makes their defaults the lowest-precedence values
+	if err := v.BindPFlags(flags); err != nil {
+		return nil, err
+	}
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	v.AutomaticEnv()
+
+	// Viper only consults the environment for keys it knows about, so register the
+	// keys that have no flag
+	for _, key := range []string{"auth.hs256_secret", "auth.jwks_file", "auth.issuer", "auth.audience",
+		"rate_limit.requests_per_second", "rate_limit.burst", "rate_limit.ip_requests_per_second", "rate_limit.ip_burst",
+		"cors.allowed_origins"} {
+		if err := v.BindEnv(key); err != nil {
+			return nil, err
+		}
+	}
+
+	// There is no default profile, so a deployment that forgets to choose one fails
+	// instead of starting with development settings
+	profile := v.GetString("profile")
+	if profile == "" {
+		return nil, fmt.Errorf("no profile selected: set --profile or %s_PROFILE to dev, staging or prod", envPrefix)
+	}
+	if !configProfiles[profile] {
+		return nil, fmt.Errorf("unknown profile %q: expected dev, staging or prod", profile)
+	}
+
+	// Read the shared file first and then merge the profile overlay on top of it
+	configDir := v.GetString("config-dir")
+	var files []string
+	v.AddConfigPath(configDir)
+	v.SetConfigName("config")
+	if err := v.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("reading config.yaml: %w", err)
+		}
+	} else {
+		files = append(files, v.ConfigFileUsed())
+	}
+	v.SetConfigName("config." + profile)
+	if err := v.MergeInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("reading config.%s.yaml: %w", profile, err)
+		}
+	} else {
+		files = append(files, v.ConfigFileUsed())
+	}
+
+	var missing []string
+	for _, key := range requiredConfigKeys {
+		if v.GetString(key) == "" {
+			envName := envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+			missing = append(missing, fmt.Sprintf("%s (flag --%s or env %s)", key, key, envName))
+		}
+	}
+	if v.GetString("auth.hs256_secret") == "" && v.GetString("auth.jwks_file") == "" {
+		missing = append(missing, fmt.Sprintf("auth.hs256_secret or auth.jwks_file (env %s_AUTH_HS256_SECRET or %s_AUTH_JWKS_FILE)", envPrefix, envPrefix))
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing required settings for profile %s:\n  %s", profile, strings.Join(missing, "\n  "))
+	}
+
+	var config Config
+	if err := v.Unmarshal(&config); err != nil {
+		return nil, fmt.Errorf("decoding configuration: %w", err)
+	}
+	if err := config.Database.Pool.validate(); err != nil {
+		return nil, err
+	}
+	if _, ok := logLevels[config.Log.Level]; !ok {
+		return nil, fmt.Errorf("invalid log.level %q: expected debug, info, warn or error", config.Log.Level)
+	}
+	if config.Log.Format != "json" && config.Log.Format != "console" {
+		return nil, fmt.Errorf("invalid log.format %q: expected json or console", config.Log.Format)
+	}
+	if err := config.Log.File.validate(); err != nil {
+		return nil, err
+	}
+	if config.RateLimit.RequestsPerSecond < 0 || config.RateLimit.Burst < 0 ||
+		config.RateLimit.IPRequestsPerSecond < 0 || config.RateLimit.IPBurst < 0 {
+		return nil, errors.New("rate_limit values must not be negative")
+	}
+	if config.QueryTimeout.Default < 0 {
+		return nil, errors.New("query_timeout.default must not be negative")
+	}
+	for route, timeout := range config.QueryTimeout.Routes {
+		if timeout < 0 {
+			return nil, fmt.Errorf("query_timeout.routes %q must not be negative", route)
+		}
+	}
+	config.Profile = profile
+	config.Files = files
+	return &config, nil
+}
 
 type OfficeMaster struct {
 	OfficeID          int       `json:"OfficeID"`
-	OfficeTypeID      int       `json:"OfficeTypeID"`
-	OfficeName        string    `json:"OfficeName"`
-	EmailID           string    `json:"EmailID"`
-	ContactNumber     string    `json:"ContactNumber"`
+	OfficeTypeID      int       `json:"OfficeTypeID" binding:"required,gt=0"`
+	OfficeName        string    `json:"OfficeName" binding:"required,max=100"`
+	EmailID           string    `json:"EmailID" binding:"omitempty,email"`
+	ContactNumber     string    `json:"ContactNumber" binding:"omitempty,contactnumber"`
 	WorkingHoursFrom  time.Time `json:"WorkingHoursFrom"`
-	WorkingHoursTo    time.Time `json:"WorkingHoursTo"`
-	DivisionID        int       `json:"DivisionID"`
-	RegionID          int       `json:"RegionID"`
-	CircleID          int       `json:"CircleID"`
-	ReportingOfficeID int64     `json:"ReportingOfficeID"`
-	Latitude          float64   `json:"Latitude"`
-	Longitude         float64   `json:"Longitude"`
+	WorkingHoursTo    time.Time `json:"WorkingHoursTo" binding:"omitempty,gtfield=WorkingHoursFrom"`
+	DivisionID        int       `json:"DivisionID" binding:"required,gt=0"`
+	RegionID          int       `json:"RegionID" binding:"required,gt=0"`
+	CircleID          int       `json:"CircleID" binding:"required,gt=0"`
+	ReportingOfficeID int64     `json:"ReportingOfficeID" binding:"gte=0"`
+	Latitude          float64   `json:"Latitude" binding:"min=-90,max=90"`
+	Longitude         float64   `json:"Longitude" binding:"min=-180,max=180"`
 	Status            string    `json:"Status"`
 	CSIFacilityID     string    `json:"CSIFacilityID"`
 	OpenToPublicDate  string    `json:"OpenToPublicDate"`
@@ -51,10 +517,10 @@ type OfficeMaster struct {
 
 type OfficeAttributeData struct {
 	AttributeID            int       `json:"AttributeID"`
-	OfficeID               int       `json:"OfficeID"`
-	OfficeTypeID           int       `json:"OfficeTypeID"`
+	OfficeID               int       `json:"OfficeID" binding:"required,gt=0"`
+	OfficeTypeID           int       `json:"OfficeTypeID" binding:"required,gt=0"`
 	OpenedDate             time.Time `json:"OpenedDate"`
-	ClosedDate             time.Time `json:"ClosedDate"`
+	ClosedDate             time.Time `json:"ClosedDate" binding:"omitempty,gtefield=OpenedDate"`
 	QRTerminalID           string    `json:"QRTerminalID"`
 	OfficeAddressLine1     string    `json:"OfficeAddressLine1"`
 	OfficeAddressLine2     string    `json:"OfficeAddressLine2"`
@@ -65,11 +531,11 @@ type OfficeAttributeData struct {
 	TalukID                int       `json:"TalukID"`
 	VillageID              int       `json:"VillageID"`
 	StateID                int       `json:"StateID"`
-	Pincode                string    `json:"Pincode"`
+	Pincode                string    `json:"Pincode" binding:"omitempty,pincode"`
 	PAOCode                string    `json:"PAOCode"`
 	SolId                  string    `json:"SolId"`
 	PLIId                  string    `json:"PLIId"`
-	GSTNForHO              string    `json:"GSTNForHO"`
+	GSTNForHO              string    `json:"GSTNForHO" binding:"omitempty,gstin"`
 	WEGCode                string    `json:"WEGCode"`
 	DDOCode                string    `json:"DDOCode"`
 	DeliveryOfficeFlag     bool      `json:"DeliveryOfficeFlag"`
@@ -81,399 +547,3475 @@ type OfficeAttributeData struct {
 	UpdatedDate            time.Time `json:"UpdatedDate"`
 }
 
-func logRequest(handler gin.HandlerFunc, logger *log.Logger) gin.HandlerFunc {
+// logRequests writes one entry per request once the response is complete, including
+// requests rejected by the auth and rate limiting middleware.
+func logRequests() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Log the request details
-		logger.Printf("Request: %s %s\n", c.Request.Method, c.Request.URL)
-
 		// Capture the start time
 		startTime := time.Now()
 
-		// Call the actual handler
-		handler(c)
+		// Call the rest of the chain
+		c.Next()
+
+		// Server errors are logged at error level so they survive a quieter log level
+		status := c.Writer.Status()
+		logger := log.Ctx(c.Request.Context())
+		event := logger.Info()
+		if status >= http.StatusInternalServerError {
+			event = logger.Error()
+		}
+		caller, _ := currentCaller(c)
+		event.
+			Str("method", c.Request.Method).
+			Str("route", c.FullPath()).
+			Str("path", c.Request.URL.Path).
+			Int("status", status).
+			Dur("latency", time.Since(startTime)).
+			Int("bytes", c.Writer.Size()).
+			Str("client_ip", c.ClientIP()).
+			Str("user_id", caller.UserID).
+			Msg("request")
+	}
+}
+
+// Problem is the RFC 7807 body returned by every handler on failure. Code is a
+// machine-readable summary of the status and Fields lists validation failures.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	Fields   []FieldError `json:"fields,omitempty"`
+
+	// CorrelationID is only set on 500s from a panic, to match reports to the logs
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// errorCodes maps HTTP statuses to the machine-readable code in Problem.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:           "bad_request",
+	http.StatusUnauthorized:         "unauthorized",
+	http.StatusForbidden:            "forbidden",
+	http.StatusNotFound:             "not_found",
+	http.StatusConflict:             "conflict",
+	http.StatusPreconditionFailed:   "precondition_failed",
+	http.StatusUnprocessableEntity:  "validation_failed",
+	http.StatusPreconditionRequired: "precondition_required",
+	http.StatusTooManyRequests:      "rate_limited",
+	http.StatusInternalServerError:  "internal_error",
+	http.StatusServiceUnavailable:   "unavailable",
+	http.StatusGatewayTimeout:       "timeout",
+}
+
+func respondProblem(c *gin.Context, status int, detail string, fields []FieldError) {
+	code, ok := errorCodes[status]
+	if !ok {
+		code = "error"
+	}
+	c.Header("Content-Type", "application/problem+json")
+	c.JSON(status, Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: c.Request.URL.Path,
+		Code:     code,
+		Fields:   fields,
+	})
+}
+
+// ErrorKind classifies the failures handlers pass to c.Error.
+type ErrorKind int
+
+const (
+	KindInternal ErrorKind = iota
+	KindBadRequest
+	KindUnauthorized
+	KindForbidden
+	KindNotFound
+	KindValidation
+	KindConflict
+	KindPreconditionFailed
+	KindPreconditionRequired
+	KindRateLimited
+	KindUnavailable
+	KindTimeout
+	KindCanceled
+)
+
+// statusClientClosedRequest is logged when the client went away before the
+// response was ready; nothing is sent.
+const statusClientClosedRequest = 499
+
+var errorKindStatus = map[ErrorKind]int{
+	KindInternal:             http.StatusInternalServerError,
+	KindBadRequest:           http.StatusBadRequest,
+	KindUnauthorized:         http.StatusUnauthorized,
+	KindForbidden:            http.StatusForbidden,
+	KindNotFound:             http.StatusNotFound,
+	KindValidation:           http.StatusUnprocessableEntity,
+	KindConflict:             http.StatusConflict,
+	KindPreconditionFailed:   http.StatusPreconditionFailed,
+	KindPreconditionRequired: http.StatusPreconditionRequired,
+	KindRateLimited:          http.StatusTooManyRequests,
+	KindUnavailable:          http.StatusServiceUnavailable,
+	KindTimeout:              http.StatusGatewayTimeout,
+	KindCanceled:             statusClientClosedRequest,
+}
+
+// AppError carries the message shown to the client alongside the underlying cause,
+// which is only logged.
+type AppError struct {
+	Kind    ErrorKind
+	Message string
+	Fields  []FieldError
+	Err     error
+}
+
+func (e *AppError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+func badRequestError(message string) error {
+	return &AppError{Kind: KindBadRequest, Message: message}
+}
+
+func unauthorizedError(message string) error {
+	return &AppError{Kind: KindUnauthorized, Message: message}
+}
+
+func forbiddenError(message string) error {
+	return &AppError{Kind: KindForbidden, Message: message}
+}
+
+func notFoundError(message string) error {
+	return &AppError{Kind: KindNotFound, Message: message}
+}
+
+func validationError(fields []FieldError) error {
+	return &AppError{Kind: KindValidation, Message: "Validation failed", Fields: fields}
+}
+
+func conflictError(message string) error {
+	return &AppError{Kind: KindConflict, Message: message}
+}
+
+func preconditionFailedError(message string) error {
+	return &AppError{Kind: KindPreconditionFailed, Message: message}
+}
+
+func preconditionRequiredError(message string) error {
+	return &AppError{Kind: KindPreconditionRequired, Message: message}
+}
+
+func rateLimitedError(message string) error {
+	return &AppError{Kind: KindRateLimited, Message: message}
+}
+
+func unavailableError(message string, err error) error {
+	return &AppError{Kind: KindUnavailable, Message: message, Err: err}
+}
+
+func internalError(message string, err error) error {
+	return &AppError{Kind: KindInternal, Message: message, Err: err}
+}
+
+// serverError wraps an unexpected failure, recognizing query timeouts, cancelled
+// requests and an unreachable database so they are not all reported as 500.
+func serverError(err error, message string) error {
+	var appErr *AppError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &appErr):
+		return err
+	case errors.Is(err, context.DeadlineExceeded):
+		return &AppError{Kind: KindTimeout, Message: "The database did not answer within the time allowed for this request", Err: err}
+	case errors.Is(err, context.Canceled):
+		return &AppError{Kind: KindCanceled, Message: "Request cancelled by the client", Err: err}
+	case errors.As(err, &netErr):
+		return unavailableError("The database is unavailable; retry later", err)
+	}
+	return internalError(message, err)
+}
+
+// recoveryMiddleware turns a panic into a problem+json 500 that carries only the
+// request ID as a correlation ID, and logs the panic and stack trace under the same ID.
+func recoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// The server uses this to abort a response deliberately
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			// The request ID is already on every log entry of the request
+			correlationID := requestID(c)
+			log.Ctx(c.Request.Context()).Error().
+				Str("method", c.Request.Method).
+				Str("route", c.FullPath()).
+				Str("path", c.Request.URL.Path).
+				Str("user_id", requestActor(c)).
+				Interface("panic", recovered).
+				Bytes("stack", debug.Stack()).
+				Msg("handler panicked")
+
+			// Nothing more can be sent once the response has started
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+			c.Header("Content-Type", "application/problem+json")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, Problem{
+				Type:          "about:blank",
+				Title:         http.StatusText(http.StatusInternalServerError),
+				Status:        http.StatusInternalServerError,
+				Detail:        "An unexpected error occurred; quote the correlation ID when reporting it",
+				Code:          errorCodes[http.StatusInternalServerError],
+				CorrelationID: correlationID,
+			})
+		}()
+		c.Next()
+	}
+}
+
+// newRequestID returns a random 16-byte hex ID for requests that arrive without one.
+func newRequestID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// openLogFile returns the log file writer. Unless RotateEvery is zero the file is also
+// rotated at each wall-clock period boundary, so a quiet server still starts a new
+// file each period, and a file left over from an earlier period is rotated at startup.
+func openLogFile(config LogFileConfig) *lumberjack.Logger {
+	logFile := &lumberjack.Logger{
+		Filename:   config.Path,
+		MaxSize:    config.MaxSizeMB,
+		MaxBackups: config.MaxBackups,
+		MaxAge:     config.MaxAgeDays,
+		Compress:   config.Compress,
+		LocalTime:  true,
+	}
+	if config.RotateEvery > 0 {
+		rotate := func() {
+			if err := logFile.Rotate(); err != nil {
+				log.Error().Err(err).Msg("log rotation failed")
+			}
+		}
+		if info, err := os.Stat(config.Path); err == nil && info.ModTime().Before(rotationPeriodStart(time.Now(), config.RotateEvery)) {
+			rotate()
+		}
+		go func() {
+			for {
+				time.Sleep(time.Until(rotationPeriodStart(time.Now(), config.RotateEvery).Add(config.RotateEvery)))
+				rotate()
+			}
+		}()
+	}
+	return logFile
+}
+
+// rotationPeriodStart returns the start of the rotation period containing now.
+// Periods that divide a day are counted from local midnight, so daily files start at
+// midnight and hourly files on the hour; longer periods are aligned to the Unix epoch.
+func rotationPeriodStart(now time.Time, period time.Duration) time.Time {
+	if (24*time.Hour)%period != 0 {
+		return now.Truncate(period)
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	return midnight.Add(now.Sub(midnight) / period * period)
+}
+
+// logWriter sends JSON to the log file, and to stdout when configured. The console
+// format adds readable output on stderr for developers.
+func logWriter(config LogConfig, logFile io.Writer) io.Writer {
+	writers := []io.Writer{logFile}
+	if config.Stdout {
+		writers = append(writers, os.Stdout)
+	}
+	if config.Format == "console" {
+		writers = append(writers, zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.Kitchen})
+	}
+	if len(writers) == 1 {
+		return logFile
+	}
+	return zerolog.MultiLevelWriter(writers...)
+}
+
+// requestIDHeader carries the request ID in both directions.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDContextKey is the gin.Context key under which requestIDMiddleware stores
+// the request ID.
+const requestIDContextKey = "requestID"
+
+// requestIDKey stores the request ID on the request context, where the database
+// pool can see it.
+type requestIDKey struct{}
+
+// validRequestID accepts IDs from callers only if they are short and printable, as
+// they end up in logs and in the database session. The 52 characters are what fits
+// after "office-api/" in application_name, so the whole ID shows in pg_stat_activity.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,52}$`)
+
+// requestIDMiddleware adopts the caller's X-Request-ID or generates one, echoes it on
+// the response and attaches it to every log entry and database session of the request.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDContextKey, id)
+		c.Header(requestIDHeader, id)
+
+		ctx := context.WithValue(c.Request.Context(), requestIDKey{}, id)
+		ctx = log.With().Str("request_id", id).Logger().WithContext(ctx)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// applicationName identifies the service in pg_stat_activity and the server logs.
+const applicationName = "office-api"
+
+// maxApplicationNameLen is the length PostgreSQL truncates application_name to.
+const maxApplicationNameLen = 63
+
+// sessionTagTimeout bounds the set_config call made when a connection changes hands.
+const sessionTagTimeout = 2 * time.Second
+
+// tagSession sets application_name to "office-api/<request ID>" when a request takes
+// a connection from the pool, so queries seen on the database side can be matched
+// to the request. Connections used outside a request carry the plain name.
+//
+// PostgreSQL reports every change of application_name back to the client, so the
+// statement is skipped when the connection already carries the tag, as it does for
+// the second and later queries of a request. It runs detached from the request's
+// cancellation: a request that timed out must not cost the pool a healthy connection.
+func tagSession(ctx context.Context, conn *pgx.Conn) bool {
+	name := applicationName
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		name += "/" + id
+	}
+	// validRequestID keeps IDs short enough that this never cuts one off
+	if len(name) > maxApplicationNameLen {
+		name = name[:maxApplicationNameLen]
+	}
+	if conn.PgConn().ParameterStatus("application_name") == name {
+		return true
+	}
+
+	tagCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sessionTagTimeout)
+	defer cancel()
+	if _, err := conn.Exec(tagCtx, "SELECT set_config('application_name', $1, false)", name); err != nil {
+		// The connection could not run a trivial statement, so let the pool replace it
+		log.Ctx(ctx).Warn().Err(err).Msg("failed to tag database session")
+		return false
+	}
+	return true
+}
+
+// routeContextKey stores the route template on the request context so failed queries
+// can be traced back to the handler that issued them.
+type routeContextKey struct{}
+
+// queryTimeoutMiddleware puts the route's query timeout on the request context. Every
+// query uses that context, so a request that runs out of time or whose client
+// disconnects cancels its query on the server.
+func queryTimeoutMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.Request.Method + " " + c.FullPath()
+		ctx := context.WithValue(c.Request.Context(), routeContextKey{}, route)
+		if timeout := liveSettings.Get().queryTimeout(route); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// queryLogger logs failed queries, naming the route and the statement. Arguments are
+// left out as they may hold credentials.
+type queryLogger struct{}
+
+func (queryLogger) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	err, _ := data["err"].(error)
+	if err == nil {
+		return
+	}
+	route, ok := ctx.Value(routeContextKey{}).(string)
+	if !ok {
+		route = "startup"
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Ctx(ctx).Warn().Str("route", route).Interface("sql", data["sql"]).Msg("query timed out")
+		return
+	case errors.Is(err, context.Canceled):
+		// The client went away; errorMiddleware reports these requests as 499 at info
+		log.Ctx(ctx).Info().Str("route", route).Interface("sql", data["sql"]).Msg("query cancelled")
+		return
+	}
+	log.Ctx(ctx).Error().Err(err).Str("route", route).Interface("sql", data["sql"]).Msg("query failed")
+}
+
+// errorMiddleware renders the last error a handler recorded with c.Error, unless
+// the handler already wrote a response.
+func errorMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		err := c.Errors.Last().Err
+		var appErr *AppError
+		if !errors.As(err, &appErr) {
+			appErr = &AppError{Kind: KindInternal, Message: "Internal server error", Err: err}
+		}
+
+		status := errorKindStatus[appErr.Kind]
+		if status == statusClientClosedRequest {
+			// The client gave up; that is routine, not a server fault
+			log.Ctx(c.Request.Context()).Info().Err(err).
+				Str("method", c.Request.Method).
+				Str("route", c.FullPath()).
+				Msg("client closed request")
+			c.Status(status)
+			return
+		}
+		if status >= http.StatusInternalServerError {
+			log.Ctx(c.Request.Context()).Error().Err(err).
+				Str("method", c.Request.Method).
+				Str("route", c.FullPath()).
+				Msg("request failed")
+		}
+		respondProblem(c, status, appErr.Message, appErr.Fields)
+	}
+}
 
-		// Calculate and log the request processing time
-		elapsed := time.Since(startTime)
-		logger.Printf("Request processed in %s\n", elapsed)
+// rowMatched reports whether result touched at least one row, responding with
+// 404 when it did not.
+func rowMatched(c *gin.Context, result pgconn.CommandTag, notFoundMessage string) bool {
+	if result.RowsAffected() == 0 {
+		c.Error(notFoundError(notFoundMessage))
+		return false
 	}
+	return true
 }
 
 func main() {
-	// Create a log file
-	logFile, err := os.Create("app.log")
+	// Log to stderr until the configuration says where logs go
+	log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+
+	// Load the configuration from flags, environment and config files
+	config, err := loadConfig(os.Args[1:])
 	if err != nil {
-		log.Fatal("Error creating log file:", err)
+		log.Fatal().Err(err).Msg("configuration error")
 	}
+
+	// Open the rotating log file, appending to the one left by the previous run
+	logFile := openLogFile(config.Log.File)
 	defer logFile.Close()
+	log.Logger = zerolog.New(logWriter(config.Log, logFile)).With().Timestamp().Logger()
+	zerolog.DefaultContextLogger = &log.Logger
+	log.Info().Str("profile", config.Profile).Msg("configuration loaded")
+
+	// Apply the settings that may change at runtime and watch the config files for edits
+	liveSettings.Store(config)
+	if err := watchConfig(config, os.Args[1:]); err != nil {
+		log.Warn().Err(err).Msg("config reload disabled")
+	}
 
-	// Initialize the logger to write to the log file
-	logger := log.New(logFile, "", log.LstdFlags)
+	// Connect to the database
+	db, err := newPool(context.Background(), config.Database)
+	if err != nil {
+		log.Fatal().Err(err).Msg("database connection error")
+	}
+	defer db.Close()
+	prometheus.MustRegister(newPoolCollector(db.Pool))
+	log.Info().Str("database", config.Database.Name).Msg("database connection established")
+
+	// Register the custom validation rules used in the binding tags
+	if err := registerValidators(); err != nil {
+		log.Fatal().Err(err).Msg("validator registration error")
+	}
+
+	// Load the keys used to verify bearer tokens
+	verifier, err := newTokenVerifier(config.Auth.HS256Secret, config.Auth.JWKSFile, config.Auth.Issuer, config.Auth.Audience)
+	if err != nil {
+		log.Fatal().Err(err).Msg("token verifier error")
+	}
+
+	// Create a new Gin router
+	// gin.Default's recovery is replaced by one that reports a correlation ID
+	r := gin.New()
+	r.Use(requestIDMiddleware(), metricsMiddleware(), logRequests(), recoveryMiddleware())
+
+	// Errors recorded by handlers are rendered as problem+json on the way out
+	r.Use(errorMiddleware())
+
+	// CORS runs first so preflight requests are answered without credentials
+	r.Use(corsMiddleware())
+	r.Use(queryTimeoutMiddleware())
+
+	// Every route requires an authenticated caller, by bearer token or API key. Client
+	// addresses are limited before authentication so rejected credentials count too;
+	// callers are limited after it
+	r.Use(ipRateLimitMiddleware())
+	r.Use(authMiddleware(verifier, db))
+	r.Use(rateLimitMiddleware())
+
+	// Define routes; each route names the API key scope it needs
+	hierarchyRead := requireScope(scopeHierarchyRead)
+	officesRead := requireScope(scopeOfficesRead, scopeOfficesWrite)
+	officesWrite := requireScope(scopeOfficesWrite)
+	adminOnly := requireRole(roleAdmin)
+
+	r.GET("/officetypes", hierarchyRead, getOfficeTypesHandler(db))
+	r.GET("/circles", hierarchyRead, getCircleNameHandler(db))
+	r.GET("/regions", hierarchyRead, getRegionsForCircleHandler(db))
+	r.GET("/divisions", hierarchyRead, getDivisionsForRegionHandler(db))
+	r.GET("/subdivisions", hierarchyRead, getSubDivisionsForDivisionHandler(db))
+	r.POST("/createoffice", officesWrite, createOfficeHandler(db))
+	r.POST("/createofficeattributes", officesWrite, createOfficeAttributeHandler(db))
+	r.PUT("/updateoffice/:OfficeID", officesWrite, updateOfficeHandler(db))
+	r.PUT("/updateofficeattribute/:AttributeID", officesWrite, updateOfficeAttributeHandler(db))
+	r.GET("/offices", officesRead, listOfficesHandler(db))
+	r.GET("/offices/:OfficeID", officesRead, getOfficeHandler(db))
+	r.PATCH("/offices/:OfficeID", officesWrite, patchOfficeHandler(db))
+	r.POST("/offices/:OfficeID/disable", officesWrite, disableOfficeHandler(db))
+	r.POST("/offices/:OfficeID/enable", officesWrite, enableOfficeHandler(db))
+	r.GET("/offices/:OfficeID/attributes", officesRead, listOfficeAttributesHandler(db))
+	r.GET("/offices/:OfficeID/detail", officesRead, getOfficeDetailHandler(db))
+	r.GET("/offices/:OfficeID/history", officesRead, requireFeature(featureOfficeHistory), getOfficeHistoryHandler(db))
+	r.GET("/officeattributes/:AttributeID", officesRead, getOfficeAttributeHandler(db))
+	r.PATCH("/officeattributes/:AttributeID", officesWrite, patchOfficeAttributeHandler(db))
+	r.DELETE("/officeattributes/:AttributeID", officesWrite, deleteOfficeAttributeHandler(db))
+	r.POST("/apikeys", adminOnly, requireFeature(featureAPIKeyAdmin), createAPIKeyHandler(db))
+	r.GET("/apikeys", adminOnly, requireFeature(featureAPIKeyAdmin), listAPIKeysHandler(db))
+	r.DELETE("/apikeys/:KeyID", adminOnly, requireFeature(featureAPIKeyAdmin), revokeAPIKeyHandler(db))
+
+	// Metrics are scraped without credentials, so they get their own listener
+	if config.Server.MetricsAddress != "" {
+		go serveMetrics(config.Server.MetricsAddress)
+	}
+
+	// Start the server
+	log.Info().Int("port", config.Server.Port).Msg("server started")
+	if err := r.Run(fmt.Sprintf(":%d", config.Server.Port)); err != nil {
+		log.Fatal().Err(err).Msg("server error")
+	}
+}
+
+func getOfficeTypesHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Use Squirrel to build the query
+		query := squirrel.Select("OfficeTypeCode", "OfficeTypeDescription").From("OfficeTypeMaster")
+
+		// Get the SQL query and arguments
+		sql, args, err := query.ToSql()
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		// Execute the query
+		rows, err := db.Query(c.Request.Context(), sql, args...)
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		defer rows.Close()
+
+		var officeTypeData []map[string]interface{}
+
+		// Iterate through the rows and build a response
+		for rows.Next() {
+			var officeTypeCode string
+			var officeTypeDescription string
+			if err := rows.Scan(&officeTypeCode, &officeTypeDescription); err != nil {
+				c.Error(serverError(err, "Failed to fetch data from the database"))
+				return
+			}
+			officeType := map[string]interface{}{"office_type_code": officeTypeCode, "office_type_description": officeTypeDescription}
+			officeTypeData = append(officeTypeData, officeType)
+		}
+
+		// Check for errors during iteration
+		if err := rows.Err(); err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		// Return the office type data as a JSON response
+		c.JSON(http.StatusOK, officeTypeData)
+	}
+}
+func getCircleNameHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Execute a query to retrieve CircleID and CircleName from the CircleMaster table
+		rows, err := db.Query(c.Request.Context(), "SELECT CircleID, CircleName FROM CircleMaster")
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		defer rows.Close()
+
+		var circleData []map[string]interface{}
+
+		// Iterate through the rows and build a response
+		for rows.Next() {
+			var circleID int
+			var circleName string
+			if err := rows.Scan(&circleID, &circleName); err != nil {
+				c.Error(serverError(err, "Failed to fetch data from the database"))
+				return
+			}
+			circle := map[string]interface{}{"circle_id": circleID, "circle_name": circleName}
+			circleData = append(circleData, circle)
+		}
+
+		// Check for errors during iteration
+		if err := rows.Err(); err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		// Return the circle data as a JSON response
+		c.JSON(http.StatusOK, circleData)
+	}
+}
+func getRegionsForCircleHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get the CircleName from the query parameters
+		circleName := c.DefaultQuery("circleName", "")
+
+		// Execute a query to retrieve region IDs and names based on CircleName
+		rows, err := db.Query(c.Request.Context(), "SELECT RegionID, RegionName FROM RegionMaster WHERE CircleID = (SELECT CircleID FROM CircleMaster WHERE CircleName = $1)", circleName)
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		defer rows.Close()
+
+		var regionData []map[string]interface{}
+
+		// Iterate through the rows and build a response
+		for rows.Next() {
+			var regionID int
+			var regionName string
+			if err := rows.Scan(&regionID, &regionName); err != nil {
+				c.Error(serverError(err, "Failed to fetch data from the database"))
+				return
+			}
+
+			// Create a map for each region with RegionID and RegionName
+			regionMap := map[string]interface{}{
+				"region_id":   regionID,
+				"region_name": regionName,
+			}
+
+			regionData = append(regionData, regionMap)
+		}
+
+		// Check for errors during iteration
+		if err := rows.Err(); err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		// Return the region data as a JSON response
+		c.JSON(http.StatusOK, regionData)
+	}
+}
+
+func getDivisionsForRegionHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get the RegionName from the query parameters
+		regionName := c.DefaultQuery("regionName", "")
+
+		// Execute a query to retrieve division IDs and names based on RegionName
+		rows, err := db.Query(c.Request.Context(), "SELECT DivisionID, DivisionName FROM DivisionMaster WHERE RegionID = (SELECT RegionID FROM RegionMaster WHERE RegionName = $1)", regionName)
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		defer rows.Close()
+
+		var divisionData []map[string]interface{}
+
+		// Iterate through the rows and build a response
+		for rows.Next() {
+			var divisionID int
+			var divisionName string
+			if err := rows.Scan(&divisionID, &divisionName); err != nil {
+				c.Error(serverError(err, "Failed to fetch data from the database"))
+				return
+			}
+
+			// Create a map for each division with DivisionID and DivisionName
+			divisionMap := map[string]interface{}{
+				"division_id":   divisionID,
+				"division_name": divisionName,
+			}
+
+			divisionData = append(divisionData, divisionMap)
+		}
+
+		// Check for errors during iteration
+		if err := rows.Err(); err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		// Return the division data as a JSON response
+		c.JSON(http.StatusOK, divisionData)
+	}
+}
+
+func getSubDivisionsForDivisionHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get the DivisionName from the query parameters
+		divisionName := c.DefaultQuery("divisionName", "")
+
+		// Execute a query to retrieve SubDivision IDs and names based on DivisionName
+		rows, err := db.Query(c.Request.Context(), "SELECT SubDivisionID, SubDivisionName FROM SubDivisionMaster WHERE DivisionID = (SELECT DivisionID FROM DivisionMaster WHERE DivisionName = $1)", divisionName)
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		defer rows.Close()
+
+		var subdivisionData []map[string]interface{}
+
+		// Iterate through the rows and build a response
+		for rows.Next() {
+			var subDivisionID int
+			var subDivisionName string
+			if err := rows.Scan(&subDivisionID, &subDivisionName); err != nil {
+				c.Error(serverError(err, "Failed to fetch data from the database"))
+				return
+			}
+
+			// Create a map for each subdivision with SubDivisionID and SubDivisionName
+			subdivisionMap := map[string]interface{}{
+				"subdivision_id":   subDivisionID,
+				"subdivision_name": subDivisionName,
+			}
+
+			subdivisionData = append(subdivisionData, subdivisionMap)
+		}
+
+		// Check for errors during iteration
+		if err := rows.Err(); err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		// Return the subdivision data as a JSON response
+		c.JSON(http.StatusOK, subdivisionData)
+	}
+}
+func createOfficeHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var officeData OfficeMaster
+		if err := c.ShouldBindJSON(&officeData); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		if !authorizeHierarchy(c, officeData.CircleID, officeData.RegionID, officeData.DivisionID) {
+			return
+		}
+
+		tx, err := db.Begin(c.Request.Context())
+		if err != nil {
+			c.Error(serverError(err, "Failed to insert data into the database"))
+			return
+		}
+		defer tx.Rollback(c.Request.Context())
+
+		// Check the hierarchy, office type and reporting office references
+		fields, err := checkOfficeReferences(c.Request.Context(), tx, officeData, nil)
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		if len(fields) > 0 {
+			respondFieldErrors(c, fields)
+			return
+		}
+
+		createdOffice, err := scanOffice(tx.QueryRow(c.Request.Context(), `
+			INSERT INTO OfficeMaster (
+				OfficeTypeID, OfficeName, EmailID, ContactNumber, WorkingHoursFrom, WorkingHoursTo, DivisionID, RegionID, CircleID, ReportingOfficeId, Latitude, Longitude, Status, CSIFacilityID, OpenToPublicDate, CreatedBy, CreatedDate, UpdatedBy, UpdatedDate, ValidatedFlag
+			) VALUES (
+				$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, NOW(), $16, NOW(), $17)
+			RETURNING `+officeColumns,
+			officeData.OfficeTypeID, officeData.OfficeName, officeData.EmailID, officeData.ContactNumber, officeData.WorkingHoursFrom, officeData.WorkingHoursTo, officeData.DivisionID, officeData.RegionID, officeData.CircleID, officeData.ReportingOfficeID, officeData.Latitude, officeData.Longitude, officeStatusActive, officeData.CSIFacilityID, officeData.OpenToPublicDate, requestActor(c), officeData.ValidatedFlag))
+
+		if err != nil {
+			c.Error(serverError(err, "Failed to insert data into the database"))
+			return
+		}
+
+		if err := writeAudit(tx, c, auditEntityOffice, createdOffice.OfficeID, createdOffice.OfficeID, auditActionCreate, nil, createdOffice); err != nil {
+			c.Error(serverError(err, "Failed to write the audit record"))
+			return
+		}
+
+		if err := tx.Commit(c.Request.Context()); err != nil {
+			c.Error(serverError(err, "Failed to insert data into the database"))
+			return
+		}
+
+		// Send the stored record along with its location
+		c.Header("Location", fmt.Sprintf("/offices/%d", createdOffice.OfficeID))
+		c.Header("ETag", recordETag(createdOffice))
+		c.JSON(http.StatusCreated, createdOffice)
+	}
+}
+
+func createOfficeAttributeHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var officeAttributeData OfficeAttributeData
+		if err := c.ShouldBindJSON(&officeAttributeData); err != nil {
+			respondBindError(c, err)
+			return
+		}
+
+		tx, err := db.Begin(c.Request.Context())
+		if err != nil {
+			c.Error(serverError(err, "Failed to insert data into the database"))
+			return
+		}
+		defer tx.Rollback(c.Request.Context())
+
+		// The parent office must exist and be within the caller's jurisdiction
+		if !authorizeOffice(c, tx, officeAttributeData.OfficeID) {
+			return
+		}
+
+		createdAttribute, err := scanOfficeAttribute(tx.QueryRow(c.Request.Context(), `
+			INSERT INTO OfficeAttributeMaster (
+				OfficeID, OfficeTypeID, OpenedDate, ClosedDate, QRTerminalID, OfficeAddressLine1, OfficeAddressLine2,
+				OfficeAddressLine3, Landmark, CityID, DistrictID, TalukID, VillageID, StateID, Pincode, PAOCode, SolId,
+				PLIId, GSTNForHO, WEGCode, DDOCode, DeliveryOfficeFlag, CSIRolledOutFlag, SingleHandedOfficeFlag,
+				CreatedBy, CreatedDate, UpdatedBy, UpdatedDate
+			) VALUES (
+				$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22,
+				$23, $24, $25, NOW(), $25, NOW()
+			)
+			RETURNING `+officeAttributeColumns,
+			officeAttributeData.OfficeID, officeAttributeData.OfficeTypeID, officeAttributeData.OpenedDate,
+			officeAttributeData.ClosedDate, officeAttributeData.QRTerminalID, officeAttributeData.OfficeAddressLine1,
+			officeAttributeData.OfficeAddressLine2, officeAttributeData.OfficeAddressLine3, officeAttributeData.Landmark,
+			officeAttributeData.CityID, officeAttributeData.DistrictID, officeAttributeData.TalukID, officeAttributeData.VillageID,
+			officeAttributeData.StateID, officeAttributeData.Pincode, officeAttributeData.PAOCode, officeAttributeData.SolId,
+			officeAttributeData.PLIId, officeAttributeData.GSTNForHO, officeAttributeData.WEGCode, officeAttributeData.DDOCode,
+			officeAttributeData.DeliveryOfficeFlag, officeAttributeData.CSIRolledOutFlag, officeAttributeData.SingleHandedOfficeFlag,
+			requestActor(c)))
+
+		if err != nil {
+			c.Error(serverError(err, "Failed to insert data into the database"))
+			return
+		}
+
+		if err := writeAudit(tx, c, auditEntityOfficeAttribute, createdAttribute.AttributeID, createdAttribute.OfficeID, auditActionCreate, nil, createdAttribute); err != nil {
+			c.Error(serverError(err, "Failed to write the audit record"))
+			return
+		}
+
+		if err := tx.Commit(c.Request.Context()); err != nil {
+			c.Error(serverError(err, "Failed to insert data into the database"))
+			return
+		}
+
+		// Send the stored record along with its location
+		c.Header("Location", fmt.Sprintf("/officeattributes/%d", createdAttribute.AttributeID))
+		c.Header("ETag", recordETag(createdAttribute))
+		c.JSON(http.StatusCreated, createdAttribute)
+	}
+}
+func updateOfficeHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		officeID, err := strconv.Atoi(c.Param("OfficeID"))
+		if err != nil {
+			c.Error(badRequestError("Invalid OfficeID"))
+			return
+		}
+		if !requireIfMatch(c) {
+			return
+		}
+
+		var officeData OfficeMaster
+		if err := c.ShouldBindJSON(&officeData); err != nil {
+			respondBindError(c, err)
+			return
+		}
+
+		tx, err := db.Begin(c.Request.Context())
+		if err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+		defer tx.Rollback(c.Request.Context())
+
+		// Lock the current row and make sure the client edited the latest version
+		current, err := scanOffice(tx.QueryRow(c.Request.Context(), "SELECT "+officeColumns+" FROM OfficeMaster WHERE OfficeID = $1 FOR UPDATE", officeID))
+		if err == pgx.ErrNoRows {
+			c.Error(notFoundError("Office not found"))
+			return
+		}
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		if !authorizeHierarchy(c, current.CircleID, current.RegionID, current.DivisionID) {
+			return
+		}
+		if !checkIfMatch(c, current) {
+			return
+		}
+
+		// The stored status fields stand; check the new dates against them
+		officeData.Status, officeData.ClosedDate = current.Status, current.ClosedDate
+		officeData.ReasonForDisable, officeData.ReasonToEnable = current.ReasonForDisable, current.ReasonToEnable
+		if err := binding.Validator.ValidateStruct(&officeData); err != nil {
+			respondBindError(c, err)
+			return
+		}
+
+		// The office may not be moved outside the caller's jurisdiction
+		if !authorizeHierarchy(c, officeData.CircleID, officeData.RegionID, officeData.DivisionID) {
+			return
+		}
+
+		// Check the hierarchy, office type and reporting office references
+		fields, err := checkOfficeReferences(c.Request.Context(), tx, officeData, &current)
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		if len(fields) > 0 {
+			respondFieldErrors(c, fields)
+			return
+		}
+
+		// Status and its dates and reasons are kept; they change through disable and enable only
+		updatedOffice, err := scanOffice(tx.QueryRow(c.Request.Context(), `
+            UPDATE OfficeMaster
+            SET OfficeTypeID = $1, OfficeName = $2, EmailID = $3, ContactNumber = $4, WorkingHoursFrom = $5,
+                WorkingHoursTo = $6, DivisionID = $7, RegionID = $8, CircleID = $9, ReportingOfficeId = $10,
+                Latitude = $11, Longitude = $12, CSIFacilityID = $13, OpenToPublicDate = $14, UpdatedBy = $15,
+                UpdatedDate = NOW(), ValidatedFlag = $16
+            WHERE OfficeID = $17
+            RETURNING `+officeColumns,
+			officeData.OfficeTypeID, officeData.OfficeName, officeData.EmailID, officeData.ContactNumber,
+			officeData.WorkingHoursFrom, officeData.WorkingHoursTo, officeData.DivisionID, officeData.RegionID,
+			officeData.CircleID, officeData.ReportingOfficeID, officeData.Latitude, officeData.Longitude,
+			officeData.CSIFacilityID, officeData.OpenToPublicDate, requestActor(c),
+			officeData.ValidatedFlag, officeID))
+
+		if err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+
+		if err := writeAudit(tx, c, auditEntityOffice, officeID, officeID, auditActionUpdate, current, updatedOffice); err != nil {
+			c.Error(serverError(err, "Failed to write the audit record"))
+			return
+		}
+
+		if err := tx.Commit(c.Request.Context()); err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+
+		c.Header("ETag", recordETag(updatedOffice))
+		c.JSON(http.StatusOK, updatedOffice)
+	}
+}
+
+func updateOfficeAttributeHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		attributeIDStr := c.Param("AttributeID")
+		attributeID, err := strconv.Atoi(attributeIDStr)
+		if err != nil {
+			c.Error(badRequestError("Invalid AttributeID"))
+			return
+		}
+		if !requireIfMatch(c) {
+			return
+		}
+
+		var officeAttributeData OfficeAttributeData
+		if err := c.ShouldBindJSON(&officeAttributeData); err != nil {
+			respondBindError(c, err)
+			return
+		}
+
+		tx, err := db.Begin(c.Request.Context())
+		if err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+		defer tx.Rollback(c.Request.Context())
+
+		// Lock the current row and make sure the client edited the latest version
+		current, err := scanOfficeAttribute(tx.QueryRow(c.Request.Context(), "SELECT "+officeAttributeColumns+" FROM OfficeAttributeMaster WHERE AttributeID = $1 FOR UPDATE", attributeID))
+		if err == pgx.ErrNoRows {
+			c.Error(notFoundError("Office attribute not found"))
+			return
+		}
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		if !authorizeOffice(c, tx, current.OfficeID) {
+			return
+		}
+		if !checkIfMatch(c, current) {
+			return
+		}
+
+		updatedAttribute, err := scanOfficeAttribute(tx.QueryRow(c.Request.Context(), `
+            UPDATE OfficeAttributeMaster
+            SET OfficeTypeID = $1, OpenedDate = $2, ClosedDate = $3, QRTerminalID = $4, OfficeAddressLine1 = $5, OfficeAddressLine2 = $6,
+                OfficeAddressLine3 = $7, Landmark = $8, CityID = $9, DistrictID = $10, TalukID = $11, VillageID = $12, StateID = $13, Pincode = $14,
+                PAOCode = $15, SolId = $16, PLIId = $17, GSTNForHO = $18, WEGCode = $19, DDOCode = $20, DeliveryOfficeFlag = $21,
+                CSIRolledOutFlag = $22, SingleHandedOfficeFlag = $23, UpdatedBy = $24, UpdatedDate = NOW()
+            WHERE AttributeID = $25
+            RETURNING `+officeAttributeColumns,
+			officeAttributeData.OfficeTypeID, officeAttributeData.OpenedDate, officeAttributeData.ClosedDate,
+			officeAttributeData.QRTerminalID, officeAttributeData.OfficeAddressLine1, officeAttributeData.OfficeAddressLine2,
+			officeAttributeData.OfficeAddressLine3, officeAttributeData.Landmark, officeAttributeData.CityID,
+			officeAttributeData.DistrictID, officeAttributeData.TalukID, officeAttributeData.VillageID,
+			officeAttributeData.StateID, officeAttributeData.Pincode, officeAttributeData.PAOCode, officeAttributeData.SolId,
+			officeAttributeData.PLIId, officeAttributeData.GSTNForHO, officeAttributeData.WEGCode, officeAttributeData.DDOCode,
+			officeAttributeData.DeliveryOfficeFlag, officeAttributeData.CSIRolledOutFlag, officeAttributeData.SingleHandedOfficeFlag,
+			requestActor(c), attributeID))
+
+		if err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+
+		if err := writeAudit(tx, c, auditEntityOfficeAttribute, attributeID, current.OfficeID, auditActionUpdate, current, updatedAttribute); err != nil {
+			c.Error(serverError(err, "Failed to write the audit record"))
+			return
+		}
+
+		if err := tx.Commit(c.Request.Context()); err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+
+		c.Header("ETag", recordETag(updatedAttribute))
+		c.JSON(http.StatusOK, updatedAttribute)
+	}
+}
+
+// officeColumns lists the OfficeMaster columns in the order scanOffice expects them.
+const officeColumns = `OfficeID, OfficeTypeID, OfficeName, EmailID, ContactNumber, WorkingHoursFrom, WorkingHoursTo,
+	DivisionID, RegionID, CircleID, ReportingOfficeId, Latitude, Longitude, Status, CSIFacilityID, OpenToPublicDate,
+	ClosedDate, ReasonForDisable, ReasonToEnable, CreatedBy, CreatedDate, UpdatedBy, UpdatedDate, ValidatedFlag`
+
+// rowScanner is satisfied by both pgx.Row and pgx.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOffice(row rowScanner) (OfficeMaster, error) {
+	var office OfficeMaster
+	var (
+		emailID, contactNumber, status, csiFacilityID, openToPublicDate, closedDate sql.NullString
+		reasonForDisable, reasonToEnable, createdBy, updatedBy, validatedFlag       sql.NullString
+		workingHoursFrom, workingHoursTo, createdDate, updatedDate                  *time.Time
+		reportingOfficeID                                                           sql.NullInt64
+		latitude, longitude                                                         sql.NullFloat64
+	)
+
+	// Nullable columns are scanned into sql.Null* values and flattened afterwards. The
+	// working hours are TIME columns, which pgx only assigns to *time.Time.
+	err := row.Scan(&office.OfficeID, &office.OfficeTypeID, &office.OfficeName, &emailID, &contactNumber,
+		&workingHoursFrom, &workingHoursTo, &office.DivisionID, &office.RegionID, &office.CircleID,
+		&reportingOfficeID, &latitude, &longitude, &status, &csiFacilityID, &openToPublicDate, &closedDate,
+		&reasonForDisable, &reasonToEnable, &createdBy, &createdDate, &updatedBy, &updatedDate, &validatedFlag)
+	if err != nil {
+		return office, err
+	}
+
+	office.EmailID = emailID.String
+	office.ContactNumber = contactNumber.String
+	office.WorkingHoursFrom = timeOrZero(workingHoursFrom)
+	office.WorkingHoursTo = timeOrZero(workingHoursTo)
+	office.ReportingOfficeID = reportingOfficeID.Int64
+	office.Latitude = latitude.Float64
+	office.Longitude = longitude.Float64
+	office.Status = status.String
+	office.CSIFacilityID = csiFacilityID.String
+	office.OpenToPublicDate = openToPublicDate.String
+	office.ClosedDate = closedDate.String
+	office.ReasonForDisable = reasonForDisable.String
+	office.ReasonToEnable = reasonToEnable.String
+	office.CreatedBy = createdBy.String
+	office.CreatedDate = timeOrZero(createdDate)
+	office.UpdatedBy = updatedBy.String
+	office.UpdatedDate = timeOrZero(updatedDate)
+	office.ValidatedFlag = validatedFlag.String
+	return office, nil
+}
+
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+func getOfficeHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		officeID, err := strconv.Atoi(c.Param("OfficeID"))
+		if err != nil {
+			c.Error(badRequestError("Invalid OfficeID"))
+			return
+		}
+
+		// Fetch the office row by its primary key
+		office, err := scanOffice(db.QueryRow(c.Request.Context(), "SELECT "+officeColumns+" FROM OfficeMaster WHERE OfficeID = $1", officeID))
+		if err == pgx.ErrNoRows {
+			c.Error(notFoundError("Office not found"))
+			return
+		}
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		if !authorizeHierarchy(c, office.CircleID, office.RegionID, office.DivisionID) {
+			return
+		}
+
+		c.Header("ETag", recordETag(office))
+		c.JSON(http.StatusOK, office)
+	}
+}
+
+// psql builds queries with PostgreSQL-style $n placeholders.
+var psql = squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+	// maxPage keeps the row offset (page-1)*pageSize within an int32
+	maxPage = math.MaxInt32/maxPageSize + 1
+)
+
+// parsePagination reads the page and pageSize query parameters, responding with 400
+// when either is out of range.
+func parsePagination(c *gin.Context) (int, int, bool) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 || page > maxPage {
+		c.Error(badRequestError(fmt.Sprintf("page must be between 1 and %d", maxPage)))
+		return 0, 0, false
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", strconv.Itoa(defaultPageSize)))
+	if err != nil || pageSize < 1 || pageSize > maxPageSize {
+		c.Error(badRequestError(fmt.Sprintf("pageSize must be between 1 and %d", maxPageSize)))
+		return 0, 0, false
+	}
+	return page, pageSize, true
+}
+
+// officeSortColumns maps the accepted sortBy values to OfficeMaster columns.
+var officeSortColumns = map[string]string{
+	"OfficeID":     "OfficeID",
+	"OfficeName":   "OfficeName",
+	"OfficeTypeID": "OfficeTypeID",
+	"CircleID":     "CircleID",
+	"RegionID":     "RegionID",
+	"DivisionID":   "DivisionID",
+	"Status":       "Status",
+	"CreatedDate":  "CreatedDate",
+	"UpdatedDate":  "UpdatedDate",
+}
+
+// likeEscaper escapes the LIKE wildcards in user-supplied prefixes.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// officeIDFilters maps the numeric query parameters of the office list to columns.
+var officeIDFilters = []struct {
+	param, column string
+}{
+	{"circleID", "CircleID"},
+	{"regionID", "RegionID"},
+	{"divisionID", "DivisionID"},
+	{"officeTypeID", "OfficeTypeID"},
+}
+
+// officeListFilters turns the listing query parameters into a WHERE clause.
+func officeListFilters(c *gin.Context) (squirrel.And, error) {
+	where := squirrel.And{}
+
+	// Numeric hierarchy filters, in a fixed order so the same query string always
+	// produces the same SQL text
+	for _, filter := range officeIDFilters {
+		value := c.Query(filter.param)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s", filter.param)
+		}
+		where = append(where, squirrel.Eq{filter.column: id})
+	}
+
+	if status := c.Query("status"); status != "" {
+		where = append(where, squirrel.Eq{"Status": status})
+	}
+	if validatedFlag := c.Query("validatedFlag"); validatedFlag != "" {
+		where = append(where, squirrel.Eq{"ValidatedFlag": validatedFlag})
+	}
+	if name := c.Query("name"); name != "" {
+		where = append(where, squirrel.ILike{"OfficeName": likeEscaper.Replace(name) + "%"})
+	}
+
+	return where, nil
+}
+
+func listOfficesHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		where, err := officeListFilters(c)
+		if err != nil {
+			c.Error(badRequestError(err.Error()))
+			return
+		}
+
+		// Only offices within the caller's jurisdiction are listed
+		caller, _ := currentCaller(c)
+		if !caller.Jurisdiction.Valid() {
+			c.Error(forbiddenError("No office jurisdiction is assigned to your account"))
+			return
+		}
+		where = append(where, caller.Jurisdiction.Filter())
+
+		// Resolve the sort key and direction against the whitelist
+		sortColumn, ok := officeSortColumns[c.DefaultQuery("sortBy", "OfficeID")]
+		if !ok {
+			c.Error(badRequestError("Invalid sortBy"))
+			return
+		}
+		sortOrder := strings.ToUpper(c.DefaultQuery("sortOrder", "ASC"))
+		if sortOrder != "ASC" && sortOrder != "DESC" {
+			c.Error(badRequestError("Invalid sortOrder"))
+			return
+		}
+
+		page, pageSize, ok := parsePagination(c)
+		if !ok {
+			return
+		}
+
+		// Count the matching rows before paging
+		countSQL, countArgs, err := psql.Select("COUNT(*)").From("OfficeMaster").Where(where).ToSql()
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		var totalCount int
+		if err := db.QueryRow(c.Request.Context(), countSQL, countArgs...).Scan(&totalCount); err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		// OfficeID is appended as a tie-breaker so pages are stable
+		query := psql.Select(officeColumns).From("OfficeMaster").Where(where).
+			OrderBy(sortColumn + " " + sortOrder).
+			Limit(uint64(pageSize)).
+			Offset(uint64((page - 1) * pageSize))
+		if sortColumn != "OfficeID" {
+			query = query.OrderBy("OfficeID " + sortOrder)
+		}
+
+		sql, args, err := query.ToSql()
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		rows, err := db.Query(c.Request.Context(), sql, args...)
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		defer rows.Close()
+
+		offices := []OfficeMaster{}
+
+		// Iterate through the rows and build a response
+		for rows.Next() {
+			office, err := scanOffice(rows)
+			if err != nil {
+				c.Error(serverError(err, "Failed to fetch data from the database"))
+				return
+			}
+			offices = append(offices, office)
+		}
+
+		// Check for errors during iteration
+		if err := rows.Err(); err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"offices":     offices,
+			"page":        page,
+			"page_size":   pageSize,
+			"total_count": totalCount,
+			"total_pages": (totalCount + pageSize - 1) / pageSize,
+		})
+	}
+}
+
+// Office status values driven by the disable/enable workflow.
+const (
+	officeStatusActive   = "Active"
+	officeStatusInactive = "Inactive"
+)
+
+// OfficeStatusChange is the request body for the disable and enable actions.
+type OfficeStatusChange struct {
+	Reason string `json:"Reason" binding:"required"`
+}
+
+func disableOfficeHandler(db *DB) gin.HandlerFunc {
+	return changeOfficeStatusHandler(db, officeStatusInactive, `
+		UPDATE OfficeMaster
+		SET Status = $1, ClosedDate = CURRENT_DATE, ReasonForDisable = $2, UpdatedBy = $3, UpdatedDate = NOW()
+		WHERE OfficeID = $4`)
+}
+
+func enableOfficeHandler(db *DB) gin.HandlerFunc {
+	return changeOfficeStatusHandler(db, officeStatusActive, `
+		UPDATE OfficeMaster
+		SET Status = $1, ClosedDate = NULL, ReasonToEnable = $2, UpdatedBy = $3, UpdatedDate = NOW()
+		WHERE OfficeID = $4`)
+}
+
+// changeOfficeStatusHandler moves an office to targetStatus using updateSQL,
+// refusing the transition if the office is already in that status.
+func changeOfficeStatusHandler(db *DB, targetStatus string, updateSQL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		officeID, err := strconv.Atoi(c.Param("OfficeID"))
+		if err != nil {
+			c.Error(badRequestError("Invalid OfficeID"))
+			return
+		}
+
+		var change OfficeStatusChange
+		if err := c.ShouldBindJSON(&change); err != nil {
+			respondBindError(c, err)
+			return
+		}
+
+		tx, err := db.Begin(c.Request.Context())
+		if err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+		defer tx.Rollback(c.Request.Context())
+
+		// Lock the row so concurrent transitions are serialised
+		current, err := scanOffice(tx.QueryRow(c.Request.Context(), "SELECT "+officeColumns+" FROM OfficeMaster WHERE OfficeID = $1 FOR UPDATE", officeID))
+		if err == pgx.ErrNoRows {
+			c.Error(notFoundError("Office not found"))
+			return
+		}
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		if !authorizeHierarchy(c, current.CircleID, current.RegionID, current.DivisionID) {
+			return
+		}
+
+		// If-Match is optional here; the status check already guards the transition
+		if c.GetHeader("If-Match") != "" && !checkIfMatch(c, current) {
+			return
+		}
+
+		if strings.EqualFold(current.Status, targetStatus) {
+			c.Error(conflictError(fmt.Sprintf("Office is already %s", targetStatus)))
+			return
+		}
+
+		if _, err := tx.Exec(c.Request.Context(), updateSQL, targetStatus, change.Reason, requestActor(c), officeID); err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+
+		// Return the office as it now stands
+		office, err := scanOffice(tx.QueryRow(c.Request.Context(), "SELECT "+officeColumns+" FROM OfficeMaster WHERE OfficeID = $1", officeID))
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		action := auditActionDisable
+		if targetStatus == officeStatusActive {
+			action = auditActionEnable
+		}
+		if err := writeAudit(tx, c, auditEntityOffice, officeID, officeID, action, current, office); err != nil {
+			c.Error(serverError(err, "Failed to write the audit record"))
+			return
+		}
+
+		if err := tx.Commit(c.Request.Context()); err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+
+		c.Header("ETag", recordETag(office))
+		c.JSON(http.StatusOK, office)
+	}
+}
+
+// officeAttributeColumns lists the OfficeAttributeMaster columns in the order scanOfficeAttribute expects them.
+const officeAttributeColumns = `AttributeID, OfficeID, OfficeTypeID, OpenedDate, ClosedDate, QRTerminalID,
+	OfficeAddressLine1, OfficeAddressLine2, OfficeAddressLine3, Landmark, CityID, DistrictID, TalukID, VillageID,
+	StateID, Pincode, PAOCode, SolId, PLIId, GSTNForHO, WEGCode, DDOCode, DeliveryOfficeFlag, CSIRolledOutFlag,
+	SingleHandedOfficeFlag, CreatedBy, CreatedDate, UpdatedBy, UpdatedDate`
+
+func scanOfficeAttribute(row rowScanner) (OfficeAttributeData, error) {
+	var attribute OfficeAttributeData
+	var (
+		openedDate, closedDate, createdDate, updatedDate                          sql.NullTime
+		qrTerminalID, addressLine1, addressLine2, addressLine3, landmark, pincode sql.NullString
+		paoCode, solID, pliID, gstnForHO, wegCode, ddoCode, createdBy, updatedBy  sql.NullString
+		cityID, districtID, talukID, villageID, stateID                           sql.NullInt64
+		deliveryOfficeFlag, csiRolledOutFlag, singleHandedOfficeFlag              sql.NullBool
+	)
+
+	// Nullable columns are scanned into sql.Null* values and flattened afterwards
+	err := row.Scan(&attribute.AttributeID, &attribute.OfficeID, &attribute.OfficeTypeID, &openedDate, &closedDate,
+		&qrTerminalID, &addressLine1, &addressLine2, &addressLine3, &landmark, &cityID, &districtID, &talukID,
+		&villageID, &stateID, &pincode, &paoCode, &solID, &pliID, &gstnForHO, &wegCode, &ddoCode,
+		&deliveryOfficeFlag, &csiRolledOutFlag, &singleHandedOfficeFlag, &createdBy, &createdDate, &updatedBy,
+		&updatedDate)
+	if err != nil {
+		return attribute, err
+	}
+
+	attribute.OpenedDate = openedDate.Time
+	attribute.ClosedDate = closedDate.Time
+	attribute.QRTerminalID = qrTerminalID.String
+	attribute.OfficeAddressLine1 = addressLine1.String
+	attribute.OfficeAddressLine2 = addressLine2.String
+	attribute.OfficeAddressLine3 = addressLine3.String
+	attribute.Landmark = landmark.String
+	attribute.CityID = int(cityID.Int64)
+	attribute.DistrictID = int(districtID.Int64)
+	attribute.TalukID = int(talukID.Int64)
+	attribute.VillageID = int(villageID.Int64)
+	attribute.StateID = int(stateID.Int64)
+	attribute.Pincode = pincode.String
+	attribute.PAOCode = paoCode.String
+	attribute.SolId = solID.String
+	attribute.PLIId = pliID.String
+	attribute.GSTNForHO = gstnForHO.String
+	attribute.WEGCode = wegCode.String
+	attribute.DDOCode = ddoCode.String
+	attribute.DeliveryOfficeFlag = deliveryOfficeFlag.Bool
+	attribute.CSIRolledOutFlag = csiRolledOutFlag.Bool
+	attribute.SingleHandedOfficeFlag = singleHandedOfficeFlag.Bool
+	attribute.CreatedBy = createdBy.String
+	attribute.CreatedDate = createdDate.Time
+	attribute.UpdatedBy = updatedBy.String
+	attribute.UpdatedDate = updatedDate.Time
+	return attribute, nil
+}
+
+func getOfficeAttributeHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		attributeID, err := strconv.Atoi(c.Param("AttributeID"))
+		if err != nil {
+			c.Error(badRequestError("Invalid AttributeID"))
+			return
+		}
+
+		attribute, err := scanOfficeAttribute(db.QueryRow(c.Request.Context(), "SELECT "+officeAttributeColumns+" FROM OfficeAttributeMaster WHERE AttributeID = $1", attributeID))
+		if err == pgx.ErrNoRows {
+			c.Error(notFoundError("Office attribute not found"))
+			return
+		}
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		if !authorizeOffice(c, db, attribute.OfficeID) {
+			return
+		}
+
+		c.Header("ETag", recordETag(attribute))
+		c.JSON(http.StatusOK, attribute)
+	}
+}
+
+func listOfficeAttributesHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		officeID, err := strconv.Atoi(c.Param("OfficeID"))
+		if err != nil {
+			c.Error(badRequestError("Invalid OfficeID"))
+			return
+		}
+
+		// Make sure the office exists so an unknown ID is not reported as an empty list
+		if !authorizeOffice(c, db, officeID) {
+			return
+		}
+
+		rows, err := db.Query(c.Request.Context(), "SELECT "+officeAttributeColumns+" FROM OfficeAttributeMaster WHERE OfficeID = $1 ORDER BY AttributeID", officeID)
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		defer rows.Close()
+
+		attributes := []OfficeAttributeData{}
+
+		// Iterate through the rows and build a response
+		for rows.Next() {
+			attribute, err := scanOfficeAttribute(rows)
+			if err != nil {
+				c.Error(serverError(err, "Failed to fetch data from the database"))
+				return
+			}
+			attributes = append(attributes, attribute)
+		}
+
+		// Check for errors during iteration
+		if err := rows.Err(); err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		c.JSON(http.StatusOK, attributes)
+	}
+}
+
+func deleteOfficeAttributeHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		attributeID, err := strconv.Atoi(c.Param("AttributeID"))
+		if err != nil {
+			c.Error(badRequestError("Invalid AttributeID"))
+			return
+		}
+
+		tx, err := db.Begin(c.Request.Context())
+		if err != nil {
+			c.Error(serverError(err, "Failed to delete data from the database"))
+			return
+		}
+		defer tx.Rollback(c.Request.Context())
+
+		// Capture the row being removed for the audit trail
+		current, err := scanOfficeAttribute(tx.QueryRow(c.Request.Context(), "SELECT "+officeAttributeColumns+" FROM OfficeAttributeMaster WHERE AttributeID = $1 FOR UPDATE", attributeID))
+		if err == pgx.ErrNoRows {
+			c.Error(notFoundError("Office attribute not found"))
+			return
+		}
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		if !authorizeOffice(c, tx, current.OfficeID) {
+			return
+		}
+
+		result, err := tx.Exec(c.Request.Context(), "DELETE FROM OfficeAttributeMaster WHERE AttributeID = $1", attributeID)
+		if err != nil {
+			c.Error(serverError(err, "Failed to delete data from the database"))
+			return
+		}
+		if !rowMatched(c, result, "Office attribute not found") {
+			return
+		}
+
+		if err := writeAudit(tx, c, auditEntityOfficeAttribute, attributeID, current.OfficeID, auditActionDelete, current, nil); err != nil {
+			c.Error(serverError(err, "Failed to write the audit record"))
+			return
+		}
+
+		if err := tx.Commit(c.Request.Context()); err != nil {
+			c.Error(serverError(err, "Failed to delete data from the database"))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Office attribute deleted successfully"})
+	}
+}
+
+// HierarchyName is an ID together with its human-readable name.
+type HierarchyName struct {
+	ID   int    `json:"ID"`
+	Name string `json:"Name"`
+}
+
+type OfficeTypeName struct {
+	OfficeTypeID          int    `json:"OfficeTypeID"`
+	OfficeTypeCode        string `json:"OfficeTypeCode"`
+	OfficeTypeDescription string `json:"OfficeTypeDescription"`
+}
+
+// OfficeDetail is the combined view returned by GET /offices/:OfficeID/detail.
+type OfficeDetail struct {
+	Office     OfficeMaster         `json:"Office"`
+	Address    *OfficeAttributeData `json:"Address"`
+	Circle     HierarchyName        `json:"Circle"`
+	Region     HierarchyName        `json:"Region"`
+	Division   HierarchyName        `json:"Division"`
+	OfficeType OfficeTypeName       `json:"OfficeType"`
+}
+
+func getOfficeDetailHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		officeID, err := strconv.Atoi(c.Param("OfficeID"))
+		if err != nil {
+			c.Error(badRequestError("Invalid OfficeID"))
+			return
+		}
+
+		var detail OfficeDetail
+		detail.Office, err = scanOffice(db.QueryRow(c.Request.Context(), "SELECT "+officeColumns+" FROM OfficeMaster WHERE OfficeID = $1", officeID))
+		if err == pgx.ErrNoRows {
+			c.Error(notFoundError("Office not found"))
+			return
+		}
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		if !authorizeHierarchy(c, detail.Office.CircleID, detail.Office.RegionID, detail.Office.DivisionID) {
+			return
+		}
+
+		// Resolve the hierarchy and office type names in one round trip
+		var circleName, regionName, divisionName, officeTypeCode, officeTypeDescription sql.NullString
+		err = db.QueryRow(c.Request.Context(), `
+			SELECT cm.CircleName, rm.RegionName, dm.DivisionName, otm.OfficeTypeCode, otm.OfficeTypeDescription
+			FROM OfficeMaster om
+			LEFT JOIN CircleMaster cm ON cm.CircleID = om.CircleID
+			LEFT JOIN RegionMaster rm ON rm.RegionID = om.RegionID
+			LEFT JOIN DivisionMaster dm ON dm.DivisionID = om.DivisionID
+			LEFT JOIN OfficeTypeMaster otm ON otm.OfficeTypeID = om.OfficeTypeID
+			WHERE om.OfficeID = $1`, officeID).Scan(&circleName, &regionName, &divisionName, &officeTypeCode, &officeTypeDescription)
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		detail.Circle = HierarchyName{ID: detail.Office.CircleID, Name: circleName.String}
+		detail.Region = HierarchyName{ID: detail.Office.RegionID, Name: regionName.String}
+		detail.Division = HierarchyName{ID: detail.Office.DivisionID, Name: divisionName.String}
+		detail.OfficeType = OfficeTypeName{
+			OfficeTypeID:          detail.Office.OfficeTypeID,
+			OfficeTypeCode:        officeTypeCode.String,
+			OfficeTypeDescription: officeTypeDescription.String,
+		}
+
+		// Attach the most recent attribute row, if the office has one
+		attribute, err := scanOfficeAttribute(db.QueryRow(c.Request.Context(), `
+			SELECT `+officeAttributeColumns+` FROM OfficeAttributeMaster
+			WHERE OfficeID = $1
+			ORDER BY COALESCE(UpdatedDate, CreatedDate) DESC NULLS LAST, AttributeID DESC
+			LIMIT 1`, officeID))
+		switch {
+		case err == pgx.ErrNoRows:
+			detail.Address = nil
+		case err != nil:
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		default:
+			detail.Address = &attribute
+		}
+
+		c.JSON(http.StatusOK, detail)
+	}
+}
+
+var (
+	pincodeRegexp       = regexp.MustCompile(`^[1-9][0-9]{5}$`)
+	gstinRegexp         = regexp.MustCompile(`^[0-9]{2}[A-Z]{5}[0-9]{4}[A-Z][1-9A-Z]Z[0-9A-Z]$`)
+	contactNumberRegexp = regexp.MustCompile(`^(?:(?:\+91[\s-]?|0)?[6-9][0-9]{9}|0[0-9]{2,4}[\s-]?[0-9]{6,8})$`)
+)
+
+// officeDateLayouts are the accepted formats for the string date fields of OfficeMaster.
+var officeDateLayouts = []string{"2006-01-02", time.RFC3339}
+
+// validationCodes maps validator tags to the codes returned to clients.
+var validationCodes = map[string]string{
+	"required":      "required",
+	"email":         "invalid_email",
+	"pincode":       "invalid_pincode",
+	"gstin":         "invalid_gstin",
+	"contactnumber": "invalid_contact_number",
+	"date":          "invalid_date",
+	"gt":            "out_of_range",
+	"gte":           "out_of_range",
+	"min":           "out_of_range",
+	"max":           "out_of_range",
+	"gtfield":       "invalid_date_order",
+	"gtefield":      "invalid_date_order",
+	"dateorder":     "invalid_date_order",
+	"oneof":         "invalid_value",
+}
+
+// FieldError describes a single failing field in a 422 response.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func registerValidators() error {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return errors.New("unexpected validator engine")
+	}
+
+	// Report fields by their JSON names
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" || name == "" {
+			return field.Name
+		}
+		return name
+	})
+
+	if err := v.RegisterValidation("pincode", func(fl validator.FieldLevel) bool {
+		return pincodeRegexp.MatchString(fl.Field().String())
+	}); err != nil {
+		return err
+	}
+	if err := v.RegisterValidation("gstin", func(fl validator.FieldLevel) bool {
+		return validGSTIN(fl.Field().String())
+	}); err != nil {
+		return err
+	}
+	if err := v.RegisterValidation("contactnumber", func(fl validator.FieldLevel) bool {
+		return contactNumberRegexp.MatchString(fl.Field().String())
+	}); err != nil {
+		return err
+	}
+
+	v.RegisterStructValidation(validateOfficeDates, OfficeMaster{})
+	return nil
+}
+
+// validGSTIN checks the GSTIN layout and its mod-36 check character.
+func validGSTIN(gstin string) bool {
+	const charset = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	if !gstinRegexp.MatchString(gstin) {
+		return false
+	}
+
+	sum := 0
+	for i := 0; i < 14; i++ {
+		product := strings.IndexByte(charset, gstin[i])
+		if i%2 == 1 {
+			product *= 2
+		}
+		sum += product/36 + product%36
+	}
+	return gstin[14] == charset[(36-sum%36)%36]
+}
+
+func parseOfficeDate(value string) (time.Time, bool) {
+	for _, layout := range officeDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// validateOfficeDates checks the string date fields of OfficeMaster and that ClosedDate
+// does not precede OpenToPublicDate.
+func validateOfficeDates(sl validator.StructLevel) {
+	office := sl.Current().Interface().(OfficeMaster)
+
+	var openDate, closedDate time.Time
+	var openOK, closedOK bool
+	if office.OpenToPublicDate != "" {
+		if openDate, openOK = parseOfficeDate(office.OpenToPublicDate); !openOK {
+			sl.ReportError(office.OpenToPublicDate, "OpenToPublicDate", "OpenToPublicDate", "date", "")
+		}
+	}
+	if office.ClosedDate != "" {
+		if closedDate, closedOK = parseOfficeDate(office.ClosedDate); !closedOK {
+			sl.ReportError(office.ClosedDate, "ClosedDate", "ClosedDate", "date", "")
+		}
+	}
+	if openOK && closedOK && closedDate.Before(openDate) {
+		sl.ReportError(office.ClosedDate, "ClosedDate", "ClosedDate", "dateorder", "OpenToPublicDate")
+	}
+}
+
+func validationMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return fmt.Sprintf("%s is required", fe.Field())
+	case "email":
+		return fmt.Sprintf("%s must be a valid email address", fe.Field())
+	case "pincode":
+		return fmt.Sprintf("%s must be a 6-digit Indian pincode", fe.Field())
+	case "gstin":
+		return fmt.Sprintf("%s must be a valid GSTIN", fe.Field())
+	case "contactnumber":
+		return fmt.Sprintf("%s must be a valid Indian mobile or landline number", fe.Field())
+	case "date":
+		return fmt.Sprintf("%s must be a date in YYYY-MM-DD or RFC 3339 format", fe.Field())
+	case "gt":
+		return fmt.Sprintf("%s must be greater than %s", fe.Field(), fe.Param())
+	case "gte", "min":
+		return fmt.Sprintf("%s must be at least %s", fe.Field(), fe.Param())
+	case "max":
+		return fmt.Sprintf("%s must be at most %s", fe.Field(), fe.Param())
+	case "oneof":
+		return fmt.Sprintf("%s must be one of: %s", fe.Field(), fe.Param())
+	case "gtfield", "gtefield", "dateorder":
+		return fmt.Sprintf("%s must be after %s", fe.Field(), fe.Param())
+	}
+	return fmt.Sprintf("%s is invalid", fe.Field())
+}
+
+// respondBindError reports malformed JSON as 400 and rule violations as 422
+// with one entry per failing field.
+func respondBindError(c *gin.Context, err error) {
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		c.Error(badRequestError("Failed to parse JSON request"))
+		return
+	}
+
+	fields := make([]FieldError, 0, len(validationErrors))
+	for _, fe := range validationErrors {
+		code, ok := validationCodes[fe.Tag()]
+		if !ok {
+			code = "invalid"
+		}
+		fields = append(fields, FieldError{Field: fe.Field(), Code: code, Message: validationMessage(fe)})
+	}
+
+	respondFieldErrors(c, fields)
+}
+
+func respondFieldErrors(c *gin.Context, fields []FieldError) {
+	c.Error(validationError(fields))
+}
+
+// queryRower is satisfied by both *DB and pgx.Tx.
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// checkOfficeReferences verifies that CircleID -> RegionID -> DivisionID form a consistent
+// chain, that OfficeTypeID exists and that ReportingOfficeID names another active office.
+// current is the stored office on update, or nil on create. On update only the references
+// that change are checked, so an office stays editable after its reporting office is
+// disabled or its hierarchy is reorganized.
+func checkOfficeReferences(ctx context.Context, db queryRower, office OfficeMaster, current *OfficeMaster) ([]FieldError, error) {
+	var selfID int64
+	checkHierarchy, checkOfficeType, checkReportingOffice := true, true, true
+	if current != nil {
+		selfID = int64(current.OfficeID)
+		checkHierarchy = office.CircleID != current.CircleID || office.RegionID != current.RegionID || office.DivisionID != current.DivisionID
+		checkOfficeType = office.OfficeTypeID != current.OfficeTypeID
+		checkReportingOffice = office.ReportingOfficeID != current.ReportingOfficeID
+	}
+	if !checkHierarchy && !checkOfficeType && !checkReportingOffice {
+		return nil, nil
+	}
+
+	var (
+		circleExists, officeTypeExists bool
+		regionCircleID, divisionRegion sql.NullInt64
+		reportingOfficeStatus          sql.NullString
+		reportingOfficeExists          bool
+	)
+
+	// Resolve every reference in a single round trip
+	err := db.QueryRow(ctx, `
+		SELECT
+			EXISTS (SELECT 1 FROM CircleMaster WHERE CircleID = $1),
+			(SELECT CircleID FROM RegionMaster WHERE RegionID = $2),
+			(SELECT RegionID FROM DivisionMaster WHERE DivisionID = $3),
+			EXISTS (SELECT 1 FROM OfficeTypeMaster WHERE OfficeTypeID = $4),
+			EXISTS (SELECT 1 FROM OfficeMaster WHERE OfficeID = $5),
+			(SELECT Status FROM OfficeMaster WHERE OfficeID = $5)`,
+		office.CircleID, office.RegionID, office.DivisionID, office.OfficeTypeID, office.ReportingOfficeID).
+		Scan(&circleExists, &regionCircleID, &divisionRegion, &officeTypeExists, &reportingOfficeExists, &reportingOfficeStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []FieldError
+	if checkHierarchy {
+		if !circleExists {
+			fields = append(fields, FieldError{Field: "CircleID", Code: "not_found", Message: "CircleID does not exist"})
+		}
+		switch {
+		case !regionCircleID.Valid:
+			fields = append(fields, FieldError{Field: "RegionID", Code: "not_found", Message: "RegionID does not exist"})
+		case int(regionCircleID.Int64) != office.CircleID:
+			fields = append(fields, FieldError{Field: "RegionID", Code: "hierarchy_mismatch", Message: "RegionID does not belong to CircleID"})
+		}
+		switch {
+		case !divisionRegion.Valid:
+			fields = append(fields, FieldError{Field: "DivisionID", Code: "not_found", Message: "DivisionID does not exist"})
+		case int(divisionRegion.Int64) != office.RegionID:
+			fields = append(fields, FieldError{Field: "DivisionID", Code: "hierarchy_mismatch", Message: "DivisionID does not belong to RegionID"})
+		}
+	}
+	if checkOfficeType && !officeTypeExists {
+		fields = append(fields, FieldError{Field: "OfficeTypeID", Code: "not_found", Message: "OfficeTypeID does not exist"})
+	}
+
+	// A ReportingOfficeID of 0 means the office reports to no one
+	if checkReportingOffice && office.ReportingOfficeID != 0 {
+		switch {
+		case selfID != 0 && office.ReportingOfficeID == selfID:
+			fields = append(fields, FieldError{Field: "ReportingOfficeID", Code: "self_reference", Message: "An office cannot report to itself"})
+		case !reportingOfficeExists:
+			fields = append(fields, FieldError{Field: "ReportingOfficeID", Code: "not_found", Message: "ReportingOfficeID does not exist"})
+		case !strings.EqualFold(reportingOfficeStatus.String, officeStatusActive):
+			fields = append(fields, FieldError{Field: "ReportingOfficeID", Code: "inactive", Message: "ReportingOfficeID is not an active office"})
+		}
+	}
+
+	return fields, nil
+}
+
+// Fields that a merge patch may never change. An office's status and the
+// fields that go with it only change through the disable and enable routes.
+var (
+	officeReadOnlyFields = map[string]bool{
+		"OfficeID": true, "Status": true, "ClosedDate": true, "ReasonForDisable": true, "ReasonToEnable": true,
+	}
+	officeAttributeReadOnlyFields = map[string]bool{"AttributeID": true, "OfficeID": true}
+)
+
+// serverManagedFields are stamped by the server and silently ignored on input.
+var serverManagedFields = []string{"CreatedBy", "CreatedDate", "UpdatedBy", "UpdatedDate"}
+
+// jsonFieldValues returns the fields of a flat struct keyed by their JSON names.
+func jsonFieldValues(v interface{}) map[string]interface{} {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	fields := make(map[string]interface{}, value.NumField())
+	for i := 0; i < value.NumField(); i++ {
+		name := strings.SplitN(value.Type().Field(i).Tag.Get("json"), ",", 2)[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = value.Field(i).Interface()
+	}
+	return fields
+}
+
+// readMergePatch parses a JSON Merge Patch (RFC 7386) body and rejects members that are
+// unknown or read-only for the target struct.
+func readMergePatch(c *gin.Context, target interface{}, readOnly map[string]bool) (map[string]json.RawMessage, []FieldError, error) {
+	body, err := c.GetRawData()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return nil, nil, err
+	}
+	for _, name := range serverManagedFields {
+		delete(patch, name)
+	}
+
+	known := jsonFieldValues(target)
+	var fields []FieldError
+	for name := range patch {
+		_, isKnown := known[name]
+		switch {
+		case readOnly[name]:
+			fields = append(fields, FieldError{Field: name, Code: "read_only", Message: fmt.Sprintf("%s cannot be changed", name)})
+		case !isKnown:
+			fields = append(fields, FieldError{Field: name, Code: "unknown_field", Message: fmt.Sprintf("%s is not a known field", name)})
+		}
+	}
+	return patch, fields, nil
+}
+
+// applyMergePatch merges patch over current and decodes the result into target.
+// Members set to null are removed, which resets them to their zero value.
+func applyMergePatch(current interface{}, patch map[string]json.RawMessage, target interface{}) error {
+	currentJSON, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(currentJSON, &merged); err != nil {
+		return err
+	}
+	for name, value := range patch {
+		if string(value) == "null" {
+			delete(merged, name)
+			continue
+		}
+		merged[name] = value
+	}
+
+	mergedJSON, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(mergedJSON, target)
+}
+
+// patchUpdate builds an UPDATE that only sets the columns named in patch, taking the values
+// from the merged record, and stamps UpdatedBy/UpdatedDate. Column names match the JSON
+// field names; nulls are stored as NULL.
+func patchUpdate(table string, patch map[string]json.RawMessage, merged interface{}, actor string) squirrel.UpdateBuilder {
+	values := jsonFieldValues(merged)
+
+	names := make([]string, 0, len(patch))
+	for name := range patch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	update := psql.Update(table)
+	for _, name := range names {
+		if string(patch[name]) == "null" {
+			update = update.Set(name, nil)
+			continue
+		}
+		update = update.Set(name, values[name])
+	}
+	return update.Set("UpdatedBy", actor).Set("UpdatedDate", squirrel.Expr("NOW()"))
+}
+
+func patchOfficeHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		officeID, err := strconv.Atoi(c.Param("OfficeID"))
+		if err != nil {
+			c.Error(badRequestError("Invalid OfficeID"))
+			return
+		}
+		if !requireIfMatch(c) {
+			return
+		}
+
+		patch, fields, err := readMergePatch(c, OfficeMaster{}, officeReadOnlyFields)
+		if err != nil {
+			c.Error(badRequestError("Failed to parse JSON request"))
+			return
+		}
+		if len(fields) > 0 {
+			respondFieldErrors(c, fields)
+			return
+		}
+		if len(patch) == 0 {
+			c.Error(badRequestError("Patch document is empty"))
+			return
+		}
+
+		tx, err := db.Begin(c.Request.Context())
+		if err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+		defer tx.Rollback(c.Request.Context())
+
+		// Lock the current row and merge the patch over it
+		current, err := scanOffice(tx.QueryRow(c.Request.Context(), "SELECT "+officeColumns+" FROM OfficeMaster WHERE OfficeID = $1 FOR UPDATE", officeID))
+		if err == pgx.ErrNoRows {
+			c.Error(notFoundError("Office not found"))
+			return
+		}
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		if !authorizeHierarchy(c, current.CircleID, current.RegionID, current.DivisionID) {
+			return
+		}
+		if !checkIfMatch(c, current) {
+			return
+		}
+
+		var officeData OfficeMaster
+		if err := applyMergePatch(current, patch, &officeData); err != nil {
+			c.Error(badRequestError("Failed to parse JSON request"))
+			return
+		}
+
+		// The merged record must pass the same rules as a full update
+		if err := binding.Validator.ValidateStruct(&officeData); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		if !authorizeHierarchy(c, officeData.CircleID, officeData.RegionID, officeData.DivisionID) {
+			return
+		}
+		fields, err = checkOfficeReferences(c.Request.Context(), tx, officeData, &current)
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		if len(fields) > 0 {
+			respondFieldErrors(c, fields)
+			return
+		}
+
+		sql, args, err := patchUpdate("OfficeMaster", patch, officeData, requestActor(c)).
+			Where(squirrel.Eq{"OfficeID": officeID}).
+			Suffix("RETURNING " + officeColumns).
+			ToSql()
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		updatedOffice, err := scanOffice(tx.QueryRow(c.Request.Context(), sql, args...))
+		if err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+
+		if err := writeAudit(tx, c, auditEntityOffice, officeID, officeID, auditActionUpdate, current, updatedOffice); err != nil {
+			c.Error(serverError(err, "Failed to write the audit record"))
+			return
+		}
+
+		if err := tx.Commit(c.Request.Context()); err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+
+		c.Header("ETag", recordETag(updatedOffice))
+		c.JSON(http.StatusOK, updatedOffice)
+	}
+}
+
+func patchOfficeAttributeHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		attributeID, err := strconv.Atoi(c.Param("AttributeID"))
+		if err != nil {
+			c.Error(badRequestError("Invalid AttributeID"))
+			return
+		}
+		if !requireIfMatch(c) {
+			return
+		}
+
+		patch, fields, err := readMergePatch(c, OfficeAttributeData{}, officeAttributeReadOnlyFields)
+		if err != nil {
+			c.Error(badRequestError("Failed to parse JSON request"))
+			return
+		}
+		if len(fields) > 0 {
+			respondFieldErrors(c, fields)
+			return
+		}
+		if len(patch) == 0 {
+			c.Error(badRequestError("Patch document is empty"))
+			return
+		}
+
+		tx, err := db.Begin(c.Request.Context())
+		if err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+		defer tx.Rollback(c.Request.Context())
+
+		// Lock the current row and merge the patch over it
+		current, err := scanOfficeAttribute(tx.QueryRow(c.Request.Context(), "SELECT "+officeAttributeColumns+" FROM OfficeAttributeMaster WHERE AttributeID = $1 FOR UPDATE", attributeID))
+		if err == pgx.ErrNoRows {
+			c.Error(notFoundError("Office attribute not found"))
+			return
+		}
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		if !authorizeOffice(c, tx, current.OfficeID) {
+			return
+		}
+		if !checkIfMatch(c, current) {
+			return
+		}
+
+		var officeAttributeData OfficeAttributeData
+		if err := applyMergePatch(current, patch, &officeAttributeData); err != nil {
+			c.Error(badRequestError("Failed to parse JSON request"))
+			return
+		}
+
+		// The merged record must pass the same rules as a full update
+		if err := binding.Validator.ValidateStruct(&officeAttributeData); err != nil {
+			respondBindError(c, err)
+			return
+		}
+
+		sql, args, err := patchUpdate("OfficeAttributeMaster", patch, officeAttributeData, requestActor(c)).
+			Where(squirrel.Eq{"AttributeID": attributeID}).
+			Suffix("RETURNING " + officeAttributeColumns).
+			ToSql()
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		updatedAttribute, err := scanOfficeAttribute(tx.QueryRow(c.Request.Context(), sql, args...))
+		if err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+
+		if err := writeAudit(tx, c, auditEntityOfficeAttribute, attributeID, current.OfficeID, auditActionUpdate, current, updatedAttribute); err != nil {
+			c.Error(serverError(err, "Failed to write the audit record"))
+			return
+		}
+
+		if err := tx.Commit(c.Request.Context()); err != nil {
+			c.Error(serverError(err, "Failed to update data in the database"))
+			return
+		}
+
+		c.Header("ETag", recordETag(updatedAttribute))
+		c.JSON(http.StatusOK, updatedAttribute)
+	}
+}
+
+// recordETag derives a strong ETag from the JSON representation of a record, so any
+// change to a stored column yields a new tag.
+func recordETag(record interface{}) string {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf(`"%x"`, sum[:16])
+}
+
+// requireIfMatch rejects updates that do not carry an If-Match header with 428.
+func requireIfMatch(c *gin.Context) bool {
+	if c.GetHeader("If-Match") == "" {
+		c.Error(preconditionRequiredError("If-Match header is required; fetch the record to obtain its ETag"))
+		return false
+	}
+	return true
+}
+
+// checkIfMatch compares the If-Match header against the current record's ETag and
+// responds with 412 when none of the supplied tags match.
+func checkIfMatch(c *gin.Context, current interface{}) bool {
+	currentETag := recordETag(current)
+	for _, tag := range strings.Split(c.GetHeader("If-Match"), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == currentETag {
+			return true
+		}
+	}
+
+	c.Header("ETag", currentETag)
+	c.Error(preconditionFailedError("The record was modified by someone else; fetch it again and retry"))
+	return false
+}
+
+// Audit entity types and actions recorded in OfficeAuditLog. The table, like ApiKeys,
+// is created by the SQL files in migrations/, which are applied before deploying.
+const (
+	auditEntityOffice          = "office"
+	auditEntityOfficeAttribute = "office_attribute"
+
+	auditActionCreate  = "create"
+	auditActionUpdate  = "update"
+	auditActionDisable = "disable"
+	auditActionEnable  = "enable"
+	auditActionDelete  = "delete"
+)
+
+// FieldChange is the before and after value of a single field in an audit record.
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// AuditEntry is one row of OfficeAuditLog as returned by the history endpoint.
+type AuditEntry struct {
+	AuditID    int64                  `json:"AuditID"`
+	EntityType string                 `json:"EntityType"`
+	EntityID   int                    `json:"EntityID"`
+	OfficeID   int                    `json:"OfficeID"`
+	Action     string                 `json:"Action"`
+	Actor      string                 `json:"Actor"`
+	RequestID  string                 `json:"RequestID"`
+	ChangedAt  time.Time              `json:"ChangedAt"`
+	Changes    map[string]FieldChange `json:"Changes"`
+}
+
+// requestActor identifies the authenticated caller making the change.
+func requestActor(c *gin.Context) string {
+	if caller, ok := currentCaller(c); ok {
+		return caller.UserID
+	}
+	return "anonymous"
+}
+
+// requestID returns the ID requestIDMiddleware assigned to the request.
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDContextKey)
+}
+
+// toJSONMap round-trips a record through JSON so it can be compared field by field.
+func toJSONMap(record interface{}) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if record == nil {
+		return fields, nil
+	}
+	body, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// diffRecords lists every field whose JSON value differs between before and after.
+// Either side may be nil for creates and deletes.
+func diffRecords(before, after interface{}) (map[string]FieldChange, error) {
+	beforeFields, err := toJSONMap(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := toJSONMap(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string]FieldChange{}
+	for name, to := range afterFields {
+		from := beforeFields[name]
+		if !reflect.DeepEqual(from, to) {
+			changes[name] = FieldChange{From: from, To: to}
+		}
+	}
+	for name, from := range beforeFields {
+		if _, ok := afterFields[name]; !ok {
+			changes[name] = FieldChange{From: from, To: nil}
+		}
+	}
+	return changes, nil
+}
+
+// writeAudit records a change in the same transaction as the change itself.
+func writeAudit(tx pgx.Tx, c *gin.Context, entityType string, entityID int, officeID int, action string, before, after interface{}) error {
+	changes, err := diffRecords(before, after)
+	if err != nil {
+		return err
+	}
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(c.Request.Context(), `
+		INSERT INTO OfficeAuditLog (EntityType, EntityID, OfficeID, Action, Actor, RequestID, Changes)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7)`,
+		entityType, entityID, officeID, action, requestActor(c), requestID(c), string(changesJSON))
+	return err
+}
+
+func getOfficeHistoryHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		officeID, err := strconv.Atoi(c.Param("OfficeID"))
+		if err != nil {
+			c.Error(badRequestError("Invalid OfficeID"))
+			return
+		}
+		if !authorizeOffice(c, db, officeID) {
+			return
+		}
+
+		page, pageSize, ok := parsePagination(c)
+		if !ok {
+			return
+		}
+
+		// History is kept after an office's attributes are deleted, so count from the log itself
+		var totalCount int
+		if err := db.QueryRow(c.Request.Context(), "SELECT COUNT(*) FROM OfficeAuditLog WHERE OfficeID = $1", officeID).Scan(&totalCount); err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		rows, err := db.Query(c.Request.Context(), `
+			SELECT AuditID, EntityType, EntityID, OfficeID, Action, Actor, COALESCE(RequestID, ''), ChangedAt, Changes
+			FROM OfficeAuditLog
+			WHERE OfficeID = $1
+			ORDER BY ChangedAt DESC, AuditID DESC
+			LIMIT $2 OFFSET $3`, officeID, pageSize, (page-1)*pageSize)
+		if err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+		defer rows.Close()
+
+		history := []AuditEntry{}
+
+		// Iterate through the rows and build a response
+		for rows.Next() {
+			var entry AuditEntry
+			var changesJSON []byte
+			if err := rows.Scan(&entry.AuditID, &entry.EntityType, &entry.EntityID, &entry.OfficeID, &entry.Action,
+				&entry.Actor, &entry.RequestID, &entry.ChangedAt, &changesJSON); err != nil {
+				c.Error(serverError(err, "Failed to fetch data from the database"))
+				return
+			}
+			if err := json.Unmarshal(changesJSON, &entry.Changes); err != nil {
+				c.Error(serverError(err, "Failed to decode the audit record"))
+				return
+			}
+			history = append(history, entry)
+		}
+
+		// Check for errors during iteration
+		if err := rows.Err(); err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"history":     history,
+			"page":        page,
+			"page_size":   pageSize,
+			"total_count": totalCount,
+			"total_pages": (totalCount + pageSize - 1) / pageSize,
+		})
+	}
+}
+
+// callerContextKey is the gin.Context key under which authMiddleware stores the Caller.
+const callerContextKey = "caller"
+
+// Caller is the authenticated identity behind a request.
+type Caller struct {
+	UserID       string       `json:"UserID"`
+	Name         string       `json:"Name"`
+	Roles        []string     `json:"Roles"`
+	Scopes       []string     `json:"Scopes"`
+	Jurisdiction Jurisdiction `json:"Jurisdiction"`
+}
+
+// CallerClaims are the JWT claims the API understands. The hierarchy IDs anchor the
+// caller's roles in the postal hierarchy.
+type CallerClaims struct {
+	jwt.RegisteredClaims
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+	Roles             []string `json:"roles"`
+	CircleID          int      `json:"circle_id"`
+	RegionID          int      `json:"region_id"`
+	DivisionID        int      `json:"division_id"`
+	SubDivisionID     int      `json:"subdivision_id"`
+}
+
+// TokenVerifier validates HS256 tokens against a shared secret and RS256 tokens against
+// the keys of a local JWKS file.
+type TokenVerifier struct {
+	hmacSecret []byte
+	rsaKeys    map[string]*rsa.PublicKey
+	parser     *jwt.Parser
+}
+
+func newTokenVerifier(hmacSecret, jwksFile, issuer, audience string) (*TokenVerifier, error) {
+	verifier := &TokenVerifier{hmacSecret: []byte(hmacSecret)}
+
+	var methods []string
+	if hmacSecret != "" {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if jwksFile != "" {
+		keys, err := loadJWKS(jwksFile)
+		if err != nil {
+			return nil, err
+		}
+		verifier.rsaKeys = keys
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("set auth.hs256_secret or auth.jwks_file to enable authentication")
+	}
+
+	options := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired(), jwt.WithLeeway(30 * time.Second)}
+	if issuer != "" {
+		options = append(options, jwt.WithIssuer(issuer))
+	}
+	if audience != "" {
+		options = append(options, jwt.WithAudience(audience))
+	}
+	verifier.parser = jwt.NewParser(options...)
+	return verifier, nil
+}
+
+// loadJWKS reads the RSA signing keys of a JWKS document, keyed by kid.
+func loadJWKS(path string) (map[string]*rsa.PublicKey, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &jwks); err != nil {
+		return nil, fmt.Errorf("parsing JWKS %s: %w", path, err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, key := range jwks.Keys {
+		if key.Kty != "RSA" || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %q: invalid modulus: %w", key.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %q: invalid exponent: %w", key.Kid, err)
+		}
+		keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS %s contains no RSA signing keys", path)
+	}
+	return keys, nil
+}
+
+func (v *TokenVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		return v.hmacSecret, nil
+	case jwt.SigningMethodRS256.Alg():
+		kid, _ := token.Header["kid"].(string)
+		if key, ok := v.rsaKeys[kid]; ok {
+			return key, nil
+		}
+		// Tokens without a kid are accepted when the JWKS holds a single key
+		if kid == "" && len(v.rsaKeys) == 1 {
+			for _, key := range v.rsaKeys {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+}
+
+// Verify parses and validates a raw bearer token.
+func (v *TokenVerifier) Verify(raw string) (*CallerClaims, error) {
+	claims := &CallerClaims{}
+	if _, err := v.parser.ParseWithClaims(raw, claims, v.keyFunc); err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+// authMiddleware rejects requests without a valid bearer token or API key and stores
+// the caller's identity on the context.
+func authMiddleware(verifier *TokenVerifier, db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := c.GetHeader(apiKeyHeader); key != "" {
+			caller, err := authenticateAPIKey(c.Request.Context(), db, key)
+			if errors.Is(err, errInvalidAPIKey) {
+				log.Ctx(c.Request.Context()).Info().Err(err).Str("client_ip", c.ClientIP()).Msg("rejected API key")
+				c.Error(unauthorizedError("Invalid, expired or revoked API key"))
+				c.Abort()
+				return
+			}
+			if err != nil {
+				// An outage is not the caller's fault; report it as such
+				c.Error(serverError(err, "Failed to verify the API key"))
+				c.Abort()
+				return
+			}
+			c.Set(callerContextKey, caller)
+			c.Next()
+			return
+		}
+
+		scheme, token, found := strings.Cut(c.GetHeader("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="office-api"`)
+			c.Error(unauthorizedError("Missing bearer token"))
+			c.Abort()
+			return
+		}
+
+		claims, err := verifier.Verify(strings.TrimSpace(token))
+		if err != nil {
+			log.Ctx(c.Request.Context()).Info().Err(err).Str("client_ip", c.ClientIP()).Msg("rejected bearer token")
+			c.Header("WWW-Authenticate", `Bearer realm="office-api", error="invalid_token"`)
+			c.Error(unauthorizedError("Invalid or expired bearer token"))
+			c.Abort()
+			return
+		}
+
+		// Sub-division clerks cannot be served until offices are assigned to sub-divisions;
+		// say so instead of admitting a caller that every office route would refuse
+		jurisdiction := jurisdictionFromClaims(claims)
+		if !jurisdiction.Valid() && slices.Contains(claims.Roles, roleSubDivisionClerk) {
+			log.Ctx(c.Request.Context()).Info().Str("user_id", claims.Subject).Msg("rejected sub-division clerk")
+			c.Error(forbiddenError("The subdivision_clerk role is not supported yet because offices are not assigned to sub-divisions; ask for the division_clerk role"))
+			c.Abort()
+			return
+		}
+
+		name := claims.Name
+		if name == "" {
+			name = claims.PreferredUsername
+		}
+		c.Set(callerContextKey, Caller{
+			UserID:       claims.Subject,
+			Name:         name,
+			Roles:        claims.Roles,
+			Scopes:       allScopes,
+			Jurisdiction: jurisdiction,
+		})
+		c.Next()
+	}
+}
+
+// currentCaller returns the identity stored by authMiddleware.
+func currentCaller(c *gin.Context) (Caller, bool) {
+	value, ok := c.Get(callerContextKey)
+	if !ok {
+		return Caller{}, false
+	}
+	caller, ok := value.(Caller)
+	return caller, ok
+}
+
+// Roles recognised in the roles claim, from broadest to narrowest scope.
+const (
+	roleAdmin            = "admin"
+	roleCircleAdmin      = "circle_admin"
+	roleRegionAdmin      = "region_admin"
+	roleDivisionClerk    = "division_clerk"
+	roleSubDivisionClerk = "subdivision_clerk"
+)
+
+// Jurisdiction levels in the Circle -> Region -> Division tree. Offices are not yet
+// mapped to sub-divisions, so there is no sub-division level.
+const (
+	levelNone = iota
+	levelDivision
+	levelRegion
+	levelCircle
+	levelNational
+)
+
+// Jurisdiction is the part of the postal hierarchy a caller may read and change.
+type Jurisdiction struct {
+	Level      int `json:"Level"`
+	CircleID   int `json:"CircleID,omitempty"`
+	RegionID   int `json:"RegionID,omitempty"`
+	DivisionID int `json:"DivisionID,omitempty"`
+}
+
+// jurisdictionFromClaims picks the broadest scope granted by the caller's roles. A role
+// only counts when the token also carries the hierarchy ID it is anchored to.
+func jurisdictionFromClaims(claims *CallerClaims) Jurisdiction {
+	best := Jurisdiction{Level: levelNone}
+	for _, role := range claims.Roles {
+		var candidate Jurisdiction
+		switch role {
+		case roleAdmin:
+			candidate = Jurisdiction{Level: levelNational}
+		case roleCircleAdmin:
+			if claims.CircleID > 0 {
+				candidate = Jurisdiction{Level: levelCircle, CircleID: claims.CircleID}
+			}
+		case roleRegionAdmin:
+			if claims.RegionID > 0 {
+				candidate = Jurisdiction{Level: levelRegion, RegionID: claims.RegionID}
+			}
+		case roleDivisionClerk:
+			if claims.DivisionID > 0 {
+				candidate = Jurisdiction{Level: levelDivision, DivisionID: claims.DivisionID}
+			}
+		case roleSubDivisionClerk:
+			// OfficeMaster has no SubDivisionID, so no office can be shown to lie within a
+			// sub-division. Widening the role to the whole division would hand it the
+			// division clerk's rights, so it grants nothing and authMiddleware rejects
+			// tokens that carry only this role.
+		}
+		if candidate.Level > best.Level {
+			best = candidate
+		}
+	}
+	return best
+}
+
+// Valid reports whether any jurisdiction was granted.
+func (j Jurisdiction) Valid() bool {
+	return j.Level != levelNone
+}
+
+// Covers reports whether an office at the given position in the hierarchy is within j.
+func (j Jurisdiction) Covers(circleID, regionID, divisionID int) bool {
+	switch j.Level {
+	case levelNational:
+		return true
+	case levelCircle:
+		return circleID == j.CircleID
+	case levelRegion:
+		return regionID == j.RegionID
+	case levelDivision:
+		return divisionID == j.DivisionID
+	}
+	return false
+}
+
+// Filter restricts an OfficeMaster query to the offices within j.
+func (j Jurisdiction) Filter() squirrel.Sqlizer {
+	switch j.Level {
+	case levelNational:
+		return squirrel.Expr("TRUE")
+	case levelCircle:
+		return squirrel.Eq{"CircleID": j.CircleID}
+	case levelRegion:
+		return squirrel.Eq{"RegionID": j.RegionID}
+	case levelDivision:
+		return squirrel.Eq{"DivisionID": j.DivisionID}
+	}
+	return squirrel.Expr("FALSE")
+}
+
+// authorizeHierarchy responds with 403 unless the office position is within the
+// caller's jurisdiction.
+func authorizeHierarchy(c *gin.Context, circleID, regionID, divisionID int) bool {
+	caller, _ := currentCaller(c)
+	if !caller.Jurisdiction.Covers(circleID, regionID, divisionID) {
+		c.Error(forbiddenError("Office is outside your jurisdiction"))
+		return false
+	}
+	return true
+}
+
+// authorizeOffice looks up where an office sits in the hierarchy and applies
+// authorizeHierarchy, responding with 404 if the office does not exist.
+func authorizeOffice(c *gin.Context, db queryRower, officeID int) bool {
+	var circleID, regionID, divisionID int
+	err := db.QueryRow(c.Request.Context(), "SELECT CircleID, RegionID, DivisionID FROM OfficeMaster WHERE OfficeID = $1", officeID).
+		Scan(&circleID, &regionID, &divisionID)
+	if err == pgx.ErrNoRows {
+		c.Error(notFoundError("Office not found"))
+		return false
+	}
+	if err != nil {
+		c.Error(serverError(err, "Failed to fetch data from the database"))
+		return false
+	}
+	return authorizeHierarchy(c, circleID, regionID, divisionID)
+}
+
+// apiKeyHeader carries the API key of machine-to-machine callers.
+const apiKeyHeader = "X-API-Key"
+
+// errInvalidAPIKey marks keys that are unknown, revoked or expired. Other errors from
+// authenticateAPIKey mean the key could not be checked.
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// apiKeyUsageInterval is how stale LastUsedAt may get before a request refreshes it.
+const apiKeyUsageInterval = time.Minute
+
+// API key scopes. Bearer token callers hold every scope.
+const (
+	scopeHierarchyRead = "hierarchy:read"
+	scopeOfficesRead   = "offices:read"
+	scopeOfficesWrite  = "offices:write"
+)
+
+var allScopes = []string{scopeHierarchyRead, scopeOfficesRead, scopeOfficesWrite}
+
+// APIKey is an ApiKeys row as shown to administrators; the key itself is never stored.
+type APIKey struct {
+	KeyID      int64      `json:"KeyID"`
+	Name       string     `json:"Name"`
+	KeyPrefix  string     `json:"KeyPrefix"`
+	Scopes     []string   `json:"Scopes"`
+	ExpiresAt  *time.Time `json:"ExpiresAt"`
+	CreatedBy  string     `json:"CreatedBy"`
+	CreatedAt  time.Time  `json:"CreatedAt"`
+	LastUsedAt *time.Time `json:"LastUsedAt"`
+	RevokedBy  string     `json:"RevokedBy,omitempty"`
+	RevokedAt  *time.Time `json:"RevokedAt"`
+}
+
+// NewAPIKey is the request body for POST /apikeys.
+type NewAPIKey struct {
+	Name      string     `json:"Name" binding:"required,max=100"`
+	Scopes    []string   `json:"Scopes" binding:"required,min=1,dive,oneof=hierarchy:read offices:read offices:write"`
+	ExpiresAt *time.Time `json:"ExpiresAt"`
+}
+
+const apiKeyColumns = `KeyID, Name, KeyPrefix, Scopes, ExpiresAt, CreatedBy, CreatedAt, LastUsedAt, COALESCE(RevokedBy, ''), RevokedAt`
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(&key.KeyID, &key.Name, &key.KeyPrefix, &key.Scopes, &expiresAt, &key.CreatedBy,
+		&key.CreatedAt, &lastUsedAt, &key.RevokedBy, &revokedAt)
+	if err != nil {
+		return key, err
+	}
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey returns a random key and the prefix used to recognise it in listings.
+func generateAPIKey() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	key := "oak_" + base64.RawURLEncoding.EncodeToString(secret)
+	return key, key[:12], nil
+}
+
+// authenticateAPIKey resolves an API key to a Caller. Keys act across the whole
+// hierarchy but only within their scopes.
+func authenticateAPIKey(ctx context.Context, db *DB, key string) (Caller, error) {
+	apiKey, err := scanAPIKey(db.QueryRow(ctx, "SELECT "+apiKeyColumns+" FROM ApiKeys WHERE KeyHash = $1", hashAPIKey(key)))
+	if err == pgx.ErrNoRows {
+		return Caller{}, fmt.Errorf("%w: unknown key", errInvalidAPIKey)
+	}
+	if err != nil {
+		return Caller{}, err
+	}
+	if apiKey.RevokedAt != nil {
+		return Caller{}, fmt.Errorf("%w: key %q was revoked", errInvalidAPIKey, apiKey.Name)
+	}
+	if apiKey.ExpiresAt != nil && time.Now().After(*apiKey.ExpiresAt) {
+		return Caller{}, fmt.Errorf("%w: key %q expired", errInvalidAPIKey, apiKey.Name)
+	}
 
-	// Connect to the database
-	postgresqldbInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		host, port, username, password, dbname)
-	db, err := sql.Open("postgres", postgresqldbInfo)
-	if err != nil {
-		logger.Fatal("Database connection error:", err)
+	// LastUsedAt only needs minute precision, so busy keys do not write on every request
+	if apiKey.LastUsedAt == nil || time.Since(*apiKey.LastUsedAt) > apiKeyUsageInterval {
+		_, err := db.Exec(ctx, `
+			UPDATE ApiKeys SET LastUsedAt = NOW()
+			WHERE KeyID = $1 AND (LastUsedAt IS NULL OR LastUsedAt < NOW() - make_interval(secs => $2))`,
+			apiKey.KeyID, apiKeyUsageInterval.Seconds())
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("api_key", apiKey.Name).Msg("failed to record API key use")
+		}
 	}
-	defer db.Close()
-	logger.Printf("Database Connection successfully established %v\n", dbname)
 
-	// Create a new Gin router
-	r := gin.Default()
-
-	// Define routes with logging
-	r.GET("/officetypes", logRequest(getOfficeTypesHandler(db), logger))
-	r.GET("/circles", logRequest(getCircleNameHandler(db), logger))
-	r.GET("/regions", logRequest(getRegionsForCircleHandler(db), logger))
-	r.GET("/divisions", logRequest(getDivisionsForRegionHandler(db), logger))
-	r.GET("/subdivisions", logRequest(getSubDivisionsForDivisionHandler(db), logger))
-	r.POST("/createoffice", logRequest(createOfficeHandler(db), logger))
-	r.POST("/createofficeattributes", logRequest(createOfficeAttributeHandler(db), logger))
-	r.PUT("/updateoffice/:OfficeID", logRequest(updateOfficeHandler(db), logger))
-	r.PUT("/updateofficeattribute/:AttributeID", logRequest(updateOfficeAttributeHandler(db), logger))
+	return Caller{
+		UserID:       "apikey:" + apiKey.Name,
+		Name:         apiKey.Name,
+		Scopes:       apiKey.Scopes,
+		Jurisdiction: Jurisdiction{Level: levelNational},
+	}, nil
+}
 
-	// Start the server
-	port := 5032
-	logger.Printf("Server started on :%d", port)
-	if err := r.Run(fmt.Sprintf(":%d", port)); err != nil {
-		logger.Fatal("Server error:", err)
+// requireScope lets the request through when the caller holds any of the given scopes.
+func requireScope(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caller, _ := currentCaller(c)
+		for _, held := range caller.Scopes {
+			for _, scope := range scopes {
+				if held == scope {
+					c.Next()
+					return
+				}
+			}
+		}
+		c.Error(forbiddenError(fmt.Sprintf("This route requires the %s scope", strings.Join(scopes, " or "))))
+		c.Abort()
 	}
 }
 
-func getOfficeTypesHandler(db *sql.DB) gin.HandlerFunc {
+// requireRole lets the request through when the bearer token carries the given role.
+func requireRole(role string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Use Squirrel to build the query
-		query := squirrel.Select("OfficeTypeCode", "OfficeTypeDescription").From("OfficeTypeMaster")
+		caller, _ := currentCaller(c)
+		for _, held := range caller.Roles {
+			if held == role {
+				c.Next()
+				return
+			}
+		}
+		c.Error(forbiddenError(fmt.Sprintf("This route requires the %s role", role)))
+		c.Abort()
+	}
+}
 
-		// Get the SQL query and arguments
-		sql, args, err := query.ToSql()
-		if err != nil {
-			log.Fatal(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+func createAPIKeyHandler(db *DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var newKey NewAPIKey
+		if err := c.ShouldBindJSON(&newKey); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		if newKey.ExpiresAt != nil && newKey.ExpiresAt.Before(time.Now()) {
+			respondFieldErrors(c, []FieldError{{Field: "ExpiresAt", Code: "out_of_range", Message: "ExpiresAt must be in the future"}})
 			return
 		}
 
-		// Execute the query
-		rows, err := db.Query(sql, args...)
+		key, prefix, err := generateAPIKey()
 		if err != nil {
-			log.Fatal(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+			c.Error(serverError(err, "Failed to generate the API key"))
 			return
 		}
-		defer rows.Close()
-
-		var officeTypeData []map[string]interface{}
 
-		// Iterate through the rows and build a response
-		for rows.Next() {
-			var officeTypeCode string
-			var officeTypeDescription string
-			if err := rows.Scan(&officeTypeCode, &officeTypeDescription); err != nil {
-				log.Fatal(err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
-				return
-			}
-			officeType := map[string]interface{}{"office_type_code": officeTypeCode, "office_type_description": officeTypeDescription}
-			officeTypeData = append(officeTypeData, officeType)
+		apiKey, err := scanAPIKey(db.QueryRow(c.Request.Context(), `
+			INSERT INTO ApiKeys (Name, KeyPrefix, KeyHash, Scopes, ExpiresAt, CreatedBy)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (Name) DO NOTHING
+			RETURNING `+apiKeyColumns,
+			newKey.Name, prefix, hashAPIKey(key), newKey.Scopes, newKey.ExpiresAt, requestActor(c)))
+		if err == pgx.ErrNoRows {
+			c.Error(conflictError("An API key with this name already exists"))
+			return
 		}
-
-		// Check for errors during iteration
-		if err := rows.Err(); err != nil {
-			log.Fatal(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		if err != nil {
+			c.Error(serverError(err, "Failed to insert data into the database"))
 			return
 		}
 
-		// Return the office type data as a JSON response
-		c.JSON(http.StatusOK, officeTypeData)
+		// The plain key is only ever returned here
+		c.Header("Location", fmt.Sprintf("/apikeys/%d", apiKey.KeyID))
+		c.JSON(http.StatusCreated, gin.H{"api_key": apiKey, "key": key})
 	}
 }
-func getCircleNameHandler(db *sql.DB) gin.HandlerFunc {
+
+func listAPIKeysHandler(db *DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Execute a query to retrieve CircleID and CircleName from the CircleMaster table
-		rows, err := db.Query("SELECT CircleID, CircleName FROM CircleMaster")
+		rows, err := db.Query(c.Request.Context(), "SELECT "+apiKeyColumns+" FROM ApiKeys ORDER BY KeyID")
 		if err != nil {
-			log.Fatal(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+			c.Error(serverError(err, "Failed to fetch data from the database"))
 			return
 		}
 		defer rows.Close()
 
-		var circleData []map[string]interface{}
+		apiKeys := []APIKey{}
 
 		// Iterate through the rows and build a response
 		for rows.Next() {
-			var circleID int
-			var circleName string
-			if err := rows.Scan(&circleID, &circleName); err != nil {
-				log.Fatal(err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+			apiKey, err := scanAPIKey(rows)
+			if err != nil {
+				c.Error(serverError(err, "Failed to fetch data from the database"))
 				return
 			}
-			circle := map[string]interface{}{"circle_id": circleID, "circle_name": circleName}
-			circleData = append(circleData, circle)
+			apiKeys = append(apiKeys, apiKey)
 		}
 
-		// Return the circle data as a JSON response
-		c.JSON(http.StatusOK, circleData)
+		// Check for errors during iteration
+		if err := rows.Err(); err != nil {
+			c.Error(serverError(err, "Failed to fetch data from the database"))
+			return
+		}
+
+		c.JSON(http.StatusOK, apiKeys)
 	}
 }
-func getRegionsForCircleHandler(db *sql.DB) gin.HandlerFunc {
+
+func revokeAPIKeyHandler(db *DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get the CircleName from the query parameters
-		circleName := c.DefaultQuery("circleName", "")
+		keyID, err := strconv.ParseInt(c.Param("KeyID"), 10, 64)
+		if err != nil {
+			c.Error(badRequestError("Invalid KeyID"))
+			return
+		}
 
-		// Execute a query to retrieve region IDs and names based on CircleName
-		rows, err := db.Query("SELECT RegionID, RegionName FROM RegionMaster WHERE CircleID = (SELECT CircleID FROM CircleMaster WHERE CircleName = $1)", circleName)
+		// Revoked keys are kept so their history stays readable
+		apiKey, err := scanAPIKey(db.QueryRow(c.Request.Context(), `
+			UPDATE ApiKeys SET RevokedBy = $1, RevokedAt = NOW()
+			WHERE KeyID = $2 AND RevokedAt IS NULL
+			RETURNING `+apiKeyColumns, requestActor(c), keyID))
+		if err == pgx.ErrNoRows {
+			c.Error(notFoundError("API key not found or already revoked"))
+			return
+		}
 		if err != nil {
-			log.Fatal(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+			c.Error(serverError(err, "Failed to update data in the database"))
 			return
 		}
-		defer rows.Close()
 
-		var regionData []map[string]interface{}
+		c.JSON(http.StatusOK, apiKey)
+	}
+}
 
-		// Iterate through the rows and build a response
-		for rows.Next() {
-			var regionID int
-			var regionName string
-			if err := rows.Scan(&regionID, &regionName); err != nil {
-				log.Fatal(err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
-				return
-			}
+// logLevels lists the values accepted in log.level.
+var logLevels = map[string]zerolog.Level{
+	"debug": zerolog.DebugLevel,
+	"info":  zerolog.InfoLevel,
+	"warn":  zerolog.WarnLevel,
+	"error": zerolog.ErrorLevel,
+}
 
-			// Create a map for each region with RegionID and RegionName
-			regionMap := map[string]interface{}{
-				"region_id":   regionID,
-				"region_name": regionName,
-			}
+// Feature toggles read from the features map. Toggles missing from the config are on.
+const (
+	featureOfficeHistory = "office_history"
+	featureAPIKeyAdmin   = "api_key_admin"
+)
 
-			regionData = append(regionData, regionMap)
-		}
+// LiveConfig is the subset of Config that is applied without a restart.
+type LiveConfig struct {
+	Log          LogConfig
+	RateLimit    RateLimitConfig
+	CORS         CORSConfig
+	QueryTimeout QueryTimeoutConfig
+	Features     map[string]bool
+}
 
-		// Return the region data as a JSON response
-		c.JSON(http.StatusOK, regionData)
-	}
+func (l *LiveConfig) featureEnabled(name string) bool {
+	enabled, ok := l.Features[name]
+	return !ok || enabled
 }
 
-func getDivisionsForRegionHandler(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// Get the RegionName from the query parameters
-		regionName := c.DefaultQuery("regionName", "")
+// queryTimeout returns the limit for a route such as "GET /offices". Viper lower-cases
+// map keys, so the lookup ignores case.
+func (l *LiveConfig) queryTimeout(route string) time.Duration {
+	if timeout, ok := l.QueryTimeout.Routes[strings.ToLower(route)]; ok {
+		return timeout
+	}
+	return l.QueryTimeout.Default
+}
 
-		// Execute a query to retrieve division IDs and names based on RegionName
-		rows, err := db.Query("SELECT DivisionID, DivisionName FROM DivisionMaster WHERE RegionID = (SELECT RegionID FROM RegionMaster WHERE RegionName = $1)", regionName)
-		if err != nil {
-			log.Fatal(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
-			return
+func (l *LiveConfig) originAllowed(origin string) bool {
+	for _, allowed := range l.CORS.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
 		}
-		defer rows.Close()
+	}
+	return false
+}
 
-		var divisionData []map[string]interface{}
+// LiveSettings publishes the current LiveConfig to request handlers.
+type LiveSettings struct {
+	current atomic.Pointer[LiveConfig]
+}
 
-		// Iterate through the rows and build a response
-		for rows.Next() {
-			var divisionID int
-			var divisionName string
-			if err := rows.Scan(&divisionID, &divisionName); err != nil {
-				log.Fatal(err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
-				return
-			}
+var liveSettings LiveSettings
 
-			// Create a map for each division with DivisionID and DivisionName
-			divisionMap := map[string]interface{}{
-				"division_id":   divisionID,
-				"division_name": divisionName,
-			}
+// Get returns the settings in force; it is safe to call from any goroutine.
+func (s *LiveSettings) Get() *LiveConfig {
+	if current := s.current.Load(); current != nil {
+		return current
+	}
+	return &LiveConfig{Log: LogConfig{Level: "info"}}
+}
 
-			divisionData = append(divisionData, divisionMap)
-		}
+// Store publishes the live part of config and applies its log level.
+func (s *LiveSettings) Store(config *Config) {
+	zerolog.SetGlobalLevel(logLevels[config.Log.Level])
+	s.current.Store(&LiveConfig{
+		Log:          config.Log,
+		RateLimit:    config.RateLimit,
+		CORS:         config.CORS,
+		QueryTimeout: config.QueryTimeout,
+		Features:     config.Features,
+	})
+}
 
-		// Return the division data as a JSON response
-		c.JSON(http.StatusOK, divisionData)
+// restartRequiredChanges names the settings that differ between old and next but
+// only take effect on restart.
+func restartRequiredChanges(old, next *Config) []string {
+	var changed []string
+	if old.Profile != next.Profile {
+		changed = append(changed, "profile")
+	}
+	if old.Server != next.Server {
+		changed = append(changed, "server")
+	}
+	if old.Database != next.Database {
+		changed = append(changed, "database")
 	}
+	if old.Auth != next.Auth {
+		changed = append(changed, "auth")
+	}
+	if old.Log.Format != next.Log.Format || old.Log.Stdout != next.Log.Stdout || old.Log.File != next.Log.File {
+		changed = append(changed, "log output")
+	}
+	return changed
 }
 
-func getSubDivisionsForDivisionHandler(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// Get the DivisionName from the query parameters
-		divisionName := c.DefaultQuery("divisionName", "")
+// watchConfig reloads the configuration whenever one of the files it was read from
+// changes. Log level, rate limits, CORS origins and feature toggles are applied at
+// once; changes to settings that need a restart are logged and ignored. A file that
+// fails to load leaves the current settings in place.
+func watchConfig(config *Config, args []string) error {
+	if len(config.Files) == 0 {
+		return errors.New("no config file to watch")
+	}
 
-		// Execute a query to retrieve SubDivision IDs and names based on DivisionName
-		rows, err := db.Query("SELECT SubDivisionID, SubDivisionName FROM SubDivisionMaster WHERE DivisionID = (SELECT DivisionID FROM DivisionMaster WHERE DivisionName = $1)", divisionName)
-		if err != nil {
-			log.Fatal(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
-			return
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// Watch the directories so editors that replace files on save are noticed too
+	watched := map[string]bool{}
+	for _, file := range config.Files {
+		watched[filepath.Clean(file)] = true
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			watcher.Close()
+			return err
 		}
-		defer rows.Close()
+	}
 
-		var subdivisionData []map[string]interface{}
+	go func() {
+		defer watcher.Close()
 
-		// Iterate through the rows and build a response
-		for rows.Next() {
-			var subDivisionID int
-			var subDivisionName string
-			if err := rows.Scan(&subDivisionID, &subDivisionName); err != nil {
-				log.Fatal(err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		// Editors often write a file in several steps, so wait for them to settle
+		var debounce *time.Timer
+		reload := func() {
+			next, err := loadConfig(args)
+			if err != nil {
+				log.Error().Err(err).Msg("config reload rejected, keeping current settings")
 				return
 			}
-
-			// Create a map for each subdivision with SubDivisionID and SubDivisionName
-			subdivisionMap := map[string]interface{}{
-				"subdivision_id":   subDivisionID,
-				"subdivision_name": subDivisionName,
+			if changed := restartRequiredChanges(config, next); len(changed) > 0 {
+				log.Warn().Strs("settings", changed).Msg("config changes that require a restart were ignored")
 			}
-
-			subdivisionData = append(subdivisionData, subdivisionMap)
+			liveSettings.Store(next)
+			log.Info().
+				Str("log_level", next.Log.Level).
+				Float64("rate_limit_rps", next.RateLimit.RequestsPerSecond).
+				Int("rate_limit_burst", next.RateLimit.Burst).
+				Float64("rate_limit_ip_rps", next.RateLimit.IPRequestsPerSecond).
+				Int("rate_limit_ip_burst", next.RateLimit.IPBurst).
+				Strs("cors_origins", next.CORS.AllowedOrigins).
+				Msg("config reloaded")
 		}
 
-		// Return the subdivision data as a JSON response
-		c.JSON(http.StatusOK, subdivisionData)
-	}
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !watched[filepath.Clean(event.Name)] || !event.Has(fsnotify.Write|fsnotify.Create) {
+					continue
+				}
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(250*time.Millisecond, reload)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error().Err(err).Msg("config watcher error")
+			}
+		}
+	}()
+	return nil
 }
-func createOfficeHandler(db *sql.DB) gin.HandlerFunc {
+
+// corsMiddleware allows the configured origins and answers preflight requests.
+func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var officeData OfficeMaster
-		if err := c.ShouldBindJSON(&officeData); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse JSON request"})
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
 			return
 		}
 
-		_, err := db.Exec(`
-			INSERT INTO OfficeMaster (
-				OfficeTypeID, OfficeName, EmailID, ContactNumber, WorkingHoursFrom, WorkingHoursTo, DivisionID, RegionID, CircleID, ReportingOfficeId, Latitude, Longitude, Status, CSIFacilityID, OpenToPublicDate, ClosedDate, ReasonForDisable, ReasonToEnable, CreatedBy, CreatedDate, UpdatedBy, UpdatedDate, ValidatedFlag
-			) VALUES (
-				$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)`,
-			officeData.OfficeTypeID, officeData.OfficeName, officeData.EmailID, officeData.ContactNumber, officeData.WorkingHoursFrom, officeData.WorkingHoursTo, officeData.DivisionID, officeData.RegionID, officeData.CircleID, officeData.ReportingOfficeID, officeData.Latitude, officeData.Longitude, officeData.Status, officeData.CSIFacilityID, officeData.OpenToPublicDate, officeData.ClosedDate, officeData.ReasonForDisable, officeData.ReasonToEnable, officeData.CreatedBy, officeData.CreatedDate, officeData.UpdatedBy, officeData.UpdatedDate, officeData.ValidatedFlag)
-
-		if err != nil {
-			log.Println(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert data into the database"})
+		c.Writer.Header().Add("Vary", "Origin")
+		if !liveSettings.Get().originAllowed(origin) {
+			if c.Request.Method == http.MethodOptions {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
 			return
 		}
 
-		// Send a success response
-		c.JSON(http.StatusCreated, gin.H{"message": "Office created successfully"})
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Header("Access-Control-Expose-Headers", "ETag, Location, X-Request-ID")
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+			c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, X-API-Key, X-Request-ID")
+			c.Header("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
 	}
 }
 
-func createOfficeAttributeHandler(db *sql.DB) gin.HandlerFunc {
+// maxRateLimitBuckets bounds the buckets kept by one limiter. Past it, buckets that
+// have refilled completely are dropped, as a new bucket would start out the same.
+const maxRateLimitBuckets = 10000
+
+// ipRateLimitMiddleware applies a token bucket per client address. It runs before
+// authentication, so requests with missing or invalid credentials are limited too.
+func ipRateLimitMiddleware() gin.HandlerFunc {
+	return rateLimiter(func(config RateLimitConfig) (float64, int) {
+		return config.IPRequestsPerSecond, config.IPBurst
+	}, func(c *gin.Context) string {
+		return c.ClientIP()
+	})
+}
+
+// rateLimitMiddleware applies a token bucket per authenticated caller.
+func rateLimitMiddleware() gin.HandlerFunc {
+	return rateLimiter(func(config RateLimitConfig) (float64, int) {
+		return config.RequestsPerSecond, config.Burst
+	}, func(c *gin.Context) string {
+		caller, _ := currentCaller(c)
+		return caller.UserID
+	})
+}
+
+// rateLimiter keeps a token bucket per key with the limits chosen from the live
+// settings. Buckets are rebuilt when the limits change at runtime.
+func rateLimiter(limitsFrom func(RateLimitConfig) (float64, int), keyOf func(*gin.Context) string) gin.HandlerFunc {
+	var (
+		mu       sync.Mutex
+		limit    float64
+		burst    int
+		limiters = map[string]*rate.Limiter{}
+	)
+
 	return func(c *gin.Context) {
-		var officeAttributeData OfficeAttributeData
-		if err := c.ShouldBindJSON(&officeAttributeData); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse JSON request"})
+		currentLimit, currentBurst := limitsFrom(liveSettings.Get().RateLimit)
+		if currentLimit == 0 {
+			c.Next()
 			return
 		}
+		currentBurst = max(currentBurst, 1)
+		key := keyOf(c)
 
-		_, err := db.Exec(`
-			INSERT INTO OfficeAttributeMaster (
-				OfficeID, OfficeTypeID, OpenedDate, ClosedDate, QRTerminalID, OfficeAddressLine1, OfficeAddressLine2,
-				OfficeAddressLine3, Landmark, CityID, DistrictID, TalukID, VillageID, StateID, Pincode, PAOCode, SolId,
-				PLIId, GSTNForHO, WEGCode, DDOCode, DeliveryOfficeFlag, CSIRolledOutFlag, SingleHandedOfficeFlag,
-				CreatedBy, CreatedDate, UpdatedBy, UpdatedDate
-			) VALUES (
-				$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22,
-				$23, $24, $25, $26, $27, $28
-			)`,
-			officeAttributeData.OfficeID, officeAttributeData.OfficeTypeID, officeAttributeData.OpenedDate,
-			officeAttributeData.ClosedDate, officeAttributeData.QRTerminalID, officeAttributeData.OfficeAddressLine1,
-			officeAttributeData.OfficeAddressLine2, officeAttributeData.OfficeAddressLine3, officeAttributeData.Landmark,
-			officeAttributeData.CityID, officeAttributeData.DistrictID, officeAttributeData.TalukID, officeAttributeData.VillageID,
-			officeAttributeData.StateID, officeAttributeData.Pincode, officeAttributeData.PAOCode, officeAttributeData.SolId,
-			officeAttributeData.PLIId, officeAttributeData.GSTNForHO, officeAttributeData.WEGCode, officeAttributeData.DDOCode,
-			officeAttributeData.DeliveryOfficeFlag, officeAttributeData.CSIRolledOutFlag, officeAttributeData.SingleHandedOfficeFlag,
-			officeAttributeData.CreatedBy, officeAttributeData.CreatedDate, officeAttributeData.UpdatedBy, officeAttributeData.UpdatedDate)
+		mu.Lock()
+		if currentLimit != limit || currentBurst != burst {
+			limit, burst = currentLimit, currentBurst
+			limiters = map[string]*rate.Limiter{}
+		}
+		limiter, ok := limiters[key]
+		if !ok {
+			if len(limiters) >= maxRateLimitBuckets {
+				for k, l := range limiters {
+					if l.Tokens() >= float64(burst) {
+						delete(limiters, k)
+					}
+				}
+			}
+			limiter = rate.NewLimiter(rate.Limit(limit), burst)
+			limiters[key] = limiter
+		}
+		mu.Unlock()
 
-		if err != nil {
-			log.Println(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert data into the database"})
+		if !limiter.Allow() {
+			c.Header("Retry-After", strconv.Itoa(int(1/currentLimit)+1))
+			c.Error(rateLimitedError("Rate limit exceeded; retry later"))
+			c.Abort()
 			return
 		}
-
-		// Send a success response
-		c.JSON(http.StatusCreated, gin.H{"message": "Office attribute created successfully"})
+		c.Next()
 	}
 }
-func updateOfficeHandler(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		officeID := c.Param("OfficeID")
 
-		var officeData OfficeMaster
-		if err := c.ShouldBindJSON(&officeData); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse JSON request"})
+// requireFeature hides a route while its feature toggle is off.
+func requireFeature(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !liveSettings.Get().featureEnabled(name) {
+			c.Error(notFoundError("This feature is disabled"))
+			c.Abort()
 			return
 		}
+		c.Next()
+	}
+}
 
-		_, err := db.Exec(`
-            UPDATE OfficeMaster
-            SET OfficeTypeID = $1, OfficeName = $2, EmailID = $3, ContactNumber = $4, WorkingHoursFrom = $5,
-                WorkingHoursTo = $6, DivisionID = $7, RegionID = $8, CircleID = $9, ReportingOfficeId = $10,
-                Latitude = $11, Longitude = $12, Status = $13, CSIFacilityID = $14, OpenToPublicDate = $15,
-                ClosedDate = $16, ReasonForDisable = $17, ReasonToEnable = $18, CreatedBy = $19, UpdatedBy = $20,
-                UpdatedDate = $21, ValidatedFlag = $22
-            WHERE OfficeID = $23`,
-			officeData.OfficeTypeID, officeData.OfficeName, officeData.EmailID, officeData.ContactNumber,
-			officeData.WorkingHoursFrom, officeData.WorkingHoursTo, officeData.DivisionID, officeData.RegionID,
-			officeData.CircleID, officeData.ReportingOfficeID, officeData.Latitude, officeData.Longitude,
-			officeData.Status, officeData.CSIFacilityID, officeData.OpenToPublicDate, officeData.ClosedDate,
-			officeData.ReasonForDisable, officeData.ReasonToEnable, officeData.CreatedBy, officeData.UpdatedBy,
-			officeData.UpdatedDate, officeData.ValidatedFlag, officeID)
+// Metrics served by serveMetrics. Requests to paths without a route are counted under
+// the route "unmatched" to keep the label set bounded.
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "officeapi_http_requests_total",
+		Help: "HTTP requests by method, route template and status.",
+	}, []string{"method", "route", "status"})
 
-		if err != nil {
-			log.Println(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update data in the database"})
-			return
-		}
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "officeapi_http_request_duration_seconds",
+		Help:    "HTTP request latency by method, route template and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	httpRequestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "officeapi_http_requests_in_flight",
+		Help: "HTTP requests currently being served, by method and route template.",
+	}, []string{"method", "route"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "officeapi_db_query_duration_seconds",
+		Help:    "Database statement latency by query name.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"query"})
+)
 
-		c.JSON(http.StatusOK, gin.H{"message": "Office updated successfully"})
+// serveMetrics exposes /metrics on its own address so the API port keeps requiring
+// authentication on every route.
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	log.Info().Str("address", address).Msg("metrics server started")
+	if err := server.ListenAndServe(); err != nil {
+		log.Error().Err(err).Msg("metrics server stopped")
 	}
 }
 
-func updateOfficeAttributeHandler(db *sql.DB) gin.HandlerFunc {
+// metricsMiddleware counts and times every request.
+func metricsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		attributeIDStr := c.Param("AttributeID")
-		attributeID, err := strconv.Atoi(attributeIDStr)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid AttributeID"})
-			return
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
 		}
+		inFlight := httpRequestsInFlight.WithLabelValues(c.Request.Method, route)
+		inFlight.Inc()
+		defer inFlight.Dec()
 
-		var officeAttributeData OfficeAttributeData
-		if err := c.ShouldBindJSON(&officeAttributeData); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse JSON request"})
-			return
-		}
+		// Capture the start time
+		startTime := time.Now()
 
-		_, err = db.Exec(`
-            UPDATE OfficeAttributeMaster
-            SET OfficeTypeID = $1, OpenedDate = $2, ClosedDate = $3, QRTerminalID = $4, OfficeAddressLine1 = $5, OfficeAddressLine2 = $6,
-                OfficeAddressLine3 = $7, Landmark = $8, CityID = $9, DistrictID = $10, TalukID = $11, VillageID = $12, StateID = $13, Pincode = $14,
-                PAOCode = $15, SolId = $16, PLIId = $17, GSTNForHO = $18, WEGCode = $19, DDOCode = $20, DeliveryOfficeFlag = $21,
-                CSIRolledOutFlag = $22, SingleHandedOfficeFlag = $23, CreatedBy = $24, CreatedDate = $25, UpdatedBy = $26, UpdatedDate = $27
-            WHERE AttributeID = $28`,
-			officeAttributeData.OfficeTypeID, officeAttributeData.OpenedDate, officeAttributeData.ClosedDate,
-			officeAttributeData.QRTerminalID, officeAttributeData.OfficeAddressLine1, officeAttributeData.OfficeAddressLine2,
-			officeAttributeData.OfficeAddressLine3, officeAttributeData.Landmark, officeAttributeData.CityID,
-			officeAttributeData.DistrictID, officeAttributeData.TalukID, officeAttributeData.VillageID,
-			officeAttributeData.StateID, officeAttributeData.Pincode, officeAttributeData.PAOCode, officeAttributeData.SolId,
-			officeAttributeData.PLIId, officeAttributeData.GSTNForHO, officeAttributeData.WEGCode, officeAttributeData.DDOCode,
-			officeAttributeData.DeliveryOfficeFlag, officeAttributeData.CSIRolledOutFlag, officeAttributeData.SingleHandedOfficeFlag,
-			officeAttributeData.CreatedBy, officeAttributeData.CreatedDate, officeAttributeData.UpdatedBy,
-			officeAttributeData.UpdatedDate, attributeID)
+		// Call the rest of the chain
+		c.Next()
 
-		if err != nil {
-			log.Println(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update data in the database"})
-			return
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequestsTotal.WithLabelValues(c.Request.Method, route, status).Inc()
+		httpRequestDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(startTime).Seconds())
+	}
+}
+
+// queryName labels a statement by its verb and the table it reads or writes, such as
+// "select officemaster" or "insert officeauditlog", so the metric has one series per
+// kind of query rather than per SQL text.
+func queryName(sql string) string {
+	words := strings.Fields(strings.ToLower(sql))
+	if len(words) == 0 {
+		return "unknown"
+	}
+	verb := words[0]
+	for i, word := range words[:len(words)-1] {
+		// A subquery in FROM is skipped in favour of a later table
+		if (word == "from" || word == "into" || (word == "update" && i == 0)) && !strings.HasPrefix(words[i+1], "(") {
+			if table := strings.Trim(words[i+1], "),;"); table != "" {
+				return verb + " " + table
+			}
 		}
+	}
+	return verb
+}
+
+// poolCollector reports connection pool statistics at scrape time.
+type poolCollector struct {
+	pool *pgxpool.Pool
 
-		c.JSON(http.StatusOK, gin.H{"message": "Office attribute updated successfully"})
+	totalConns      *prometheus.Desc
+	idleConns       *prometheus.Desc
+	acquiredConns   *prometheus.Desc
+	maxConns        *prometheus.Desc
+	acquireCount    *prometheus.Desc
+	waitCount       *prometheus.Desc
+	acquireDuration *prometheus.Desc
+	canceledAcquire *prometheus.Desc
+}
+
+func newPoolCollector(pool *pgxpool.Pool) *poolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc("officeapi_db_pool_"+name, help, nil, nil)
+	}
+	return &poolCollector{
+		pool:            pool,
+		totalConns:      desc("open_connections", "Connections open, whether idle or in use."),
+		idleConns:       desc("idle_connections", "Connections open and idle."),
+		acquiredConns:   desc("in_use_connections", "Connections currently acquired by a request."),
+		maxConns:        desc("max_connections", "Configured maximum number of connections."),
+		acquireCount:    desc("acquires_total", "Connections acquired from the pool."),
+		waitCount:       desc("waits_total", "Acquires that had to wait for a connection to become available."),
+		acquireDuration: desc("acquire_seconds_total", "Total time spent acquiring connections, whether or not the acquire had to wait."),
+		canceledAcquire: desc("canceled_acquires_total", "Acquires abandoned because the request context ended."),
+	}
+}
+
+func (p *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{p.totalConns, p.idleConns, p.acquiredConns, p.maxConns,
+		p.acquireCount, p.waitCount, p.acquireDuration, p.canceledAcquire} {
+		ch <- d
 	}
 }
+
+func (p *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := p.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(p.totalConns, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(p.idleConns, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(p.acquiredConns, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(p.maxConns, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(p.acquireCount, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(p.waitCount, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(p.acquireDuration, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+	ch <- prometheus.MustNewConstMetric(p.canceledAcquire, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+}
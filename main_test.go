@@ -0,0 +1,1409 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
+)
+
+func TestJurisdictionFromClaims(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims CallerClaims
+		want   Jurisdiction
+	}{
+		{"no roles", CallerClaims{CircleID: 1}, Jurisdiction{Level: levelNone}},
+		{"unknown role", CallerClaims{Roles: []string{"auditor"}, CircleID: 1}, Jurisdiction{Level: levelNone}},
+		{"admin", CallerClaims{Roles: []string{roleAdmin}}, Jurisdiction{Level: levelNational}},
+		{"circle admin", CallerClaims{Roles: []string{roleCircleAdmin}, CircleID: 3}, Jurisdiction{Level: levelCircle, CircleID: 3}},
+		{"circle admin without circle", CallerClaims{Roles: []string{roleCircleAdmin}, RegionID: 4}, Jurisdiction{Level: levelNone}},
+		{"region admin", CallerClaims{Roles: []string{roleRegionAdmin}, RegionID: 4}, Jurisdiction{Level: levelRegion, RegionID: 4}},
+		{"division clerk", CallerClaims{Roles: []string{roleDivisionClerk}, DivisionID: 5}, Jurisdiction{Level: levelDivision, DivisionID: 5}},
+		{"division clerk without division", CallerClaims{Roles: []string{roleDivisionClerk}}, Jurisdiction{Level: levelNone}},
+		{"sub-division clerk gets no offices", CallerClaims{Roles: []string{roleSubDivisionClerk}, DivisionID: 5, SubDivisionID: 6}, Jurisdiction{Level: levelNone}},
+		{"broadest role wins", CallerClaims{Roles: []string{roleDivisionClerk, roleCircleAdmin}, CircleID: 3, DivisionID: 5}, Jurisdiction{Level: levelCircle, CircleID: 3}},
+		{"unanchored broad role ignored", CallerClaims{Roles: []string{roleCircleAdmin, roleDivisionClerk}, DivisionID: 5}, Jurisdiction{Level: levelDivision, DivisionID: 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jurisdictionFromClaims(&tt.claims); got != tt.want {
+				t.Errorf("jurisdictionFromClaims() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJurisdictionCovers(t *testing.T) {
+	tests := []struct {
+		name                           string
+		jurisdiction                   Jurisdiction
+		circleID, regionID, divisionID int
+		want                           bool
+	}{
+		{"none", Jurisdiction{Level: levelNone}, 1, 2, 3, false},
+		{"national", Jurisdiction{Level: levelNational}, 1, 2, 3, true},
+		{"own circle", Jurisdiction{Level: levelCircle, CircleID: 1}, 1, 2, 3, true},
+		{"other circle", Jurisdiction{Level: levelCircle, CircleID: 9}, 1, 2, 3, false},
+		{"own region", Jurisdiction{Level: levelRegion, RegionID: 2}, 1, 2, 3, true},
+		{"other region", Jurisdiction{Level: levelRegion, RegionID: 9}, 1, 2, 3, false},
+		{"own division", Jurisdiction{Level: levelDivision, DivisionID: 3}, 1, 2, 3, true},
+		{"other division", Jurisdiction{Level: levelDivision, DivisionID: 9}, 1, 2, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.jurisdiction.Covers(tt.circleID, tt.regionID, tt.divisionID); got != tt.want {
+				t.Errorf("Covers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJurisdictionFilter(t *testing.T) {
+	tests := []struct {
+		name         string
+		jurisdiction Jurisdiction
+		wantSQL      string
+		wantArgs     []interface{}
+	}{
+		{"none", Jurisdiction{Level: levelNone}, "FALSE", nil},
+		{"national", Jurisdiction{Level: levelNational}, "TRUE", nil},
+		{"circle", Jurisdiction{Level: levelCircle, CircleID: 1}, "CircleID = ?", []interface{}{1}},
+		{"region", Jurisdiction{Level: levelRegion, RegionID: 2}, "RegionID = ?", []interface{}{2}},
+		{"division", Jurisdiction{Level: levelDivision, DivisionID: 3}, "DivisionID = ?", []interface{}{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, args, err := tt.jurisdiction.Filter().ToSql()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sql != tt.wantSQL || !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("Filter() = %q %v, want %q %v", sql, args, tt.wantSQL, tt.wantArgs)
+			}
+		})
+	}
+}
+
+// writeJWKS stores the public halves of keys as a JWKS file and returns its path.
+func writeJWKS(t *testing.T, keys map[string]*rsa.PrivateKey) string {
+	t.Helper()
+	type jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range keys {
+		doc.Keys = append(doc.Keys, jwk{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, body, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTokenVerifierVerify(t *testing.T) {
+	const secret = "test-secret"
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hsOnly, err := newTokenVerifier(secret, "", "office-idp", "office-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsOnly, err := newTokenVerifier("", writeJWKS(t, map[string]*rsa.PrivateKey{"k1": rsaKey, "k2": otherKey}), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsSingle, err := newTokenVerifier("", writeJWKS(t, map[string]*rsa.PrivateKey{"only": rsaKey}), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "user-1",
+			"iss": "office-idp",
+			"aud": "office-api",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	hs256 := func(claims jwt.MapClaims) string {
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	rs256 := func(claims jwt.MapClaims, kid string, key *rsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	with := func(change func(jwt.MapClaims)) jwt.MapClaims {
+		claims := validClaims()
+		change(claims)
+		return claims
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs384, err := jwt.NewWithClaims(jwt.SigningMethodHS384, validClaims()).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An HS256 token keyed with the RSA public key must not pass as RS256
+	publicKeyAsSecret, err := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims()).SignedString(rsaKey.N.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		verifier *TokenVerifier
+		token    string
+		wantErr  bool
+	}{
+		{"valid HS256", hsOnly, hs256(validClaims()), false},
+		{"wrong secret", hsOnly, func() string {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims()).SignedString([]byte("other"))
+			return signed
+		}(), true},
+		{"missing subject", hsOnly, hs256(with(func(c jwt.MapClaims) { delete(c, "sub") })), true},
+		{"missing expiry", hsOnly, hs256(with(func(c jwt.MapClaims) { delete(c, "exp") })), true},
+		{"expired beyond leeway", hsOnly, hs256(with(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() })), true},
+		{"expired within leeway", hsOnly, hs256(with(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-10 * time.Second).Unix() })), false},
+		{"wrong issuer", hsOnly, hs256(with(func(c jwt.MapClaims) { c["iss"] = "elsewhere" })), true},
+		{"wrong audience", hsOnly, hs256(with(func(c jwt.MapClaims) { c["aud"] = "other-api" })), true},
+		{"alg none", hsOnly, unsigned, true},
+		{"HS384 not allowed", hsOnly, hs384, true},
+		{"RS256 not configured", hsOnly, rs256(validClaims(), "k1", rsaKey), true},
+		{"valid RS256 by kid", rsOnly, rs256(validClaims(), "k1", rsaKey), false},
+		{"second key by kid", rsOnly, rs256(validClaims(), "k2", otherKey), false},
+		{"kid names another key", rsOnly, rs256(validClaims(), "k2", rsaKey), true},
+		{"unknown kid", rsOnly, rs256(validClaims(), "k3", rsaKey), true},
+		{"no kid with several keys", rsOnly, rs256(validClaims(), "", rsaKey), true},
+		{"no kid with a single key", rsSingle, rs256(validClaims(), "", rsaKey), false},
+		{"HS256 not configured", rsOnly, hs256(validClaims()), true},
+		{"public key used as HMAC secret", rsOnly, publicKeyAsSecret, true},
+		{"garbage", hsOnly, "not.a.token", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := tt.verifier.Verify(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && claims.Subject != "user-1" {
+				t.Errorf("Verify() subject = %q, want user-1", claims.Subject)
+			}
+		})
+	}
+}
+
+func TestNewTokenVerifierRequiresAKey(t *testing.T) {
+	if _, err := newTokenVerifier("", "", "", ""); err == nil {
+		t.Error("newTokenVerifier() without a secret or JWKS succeeded")
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name     string
+		caller   *Caller
+		required []string
+		want     int
+	}{
+		{"no caller", nil, []string{scopeOfficesRead}, http.StatusForbidden},
+		{"no scopes", &Caller{UserID: "u"}, []string{scopeOfficesRead}, http.StatusForbidden},
+		{"held scope", &Caller{UserID: "u", Scopes: []string{scopeOfficesRead}}, []string{scopeOfficesRead}, http.StatusOK},
+		{"any of several", &Caller{UserID: "u", Scopes: []string{scopeOfficesWrite}}, []string{scopeOfficesRead, scopeOfficesWrite}, http.StatusOK},
+		{"other scope only", &Caller{UserID: "u", Scopes: []string{scopeHierarchyRead}}, []string{scopeOfficesWrite}, http.StatusForbidden},
+		{"bearer callers hold all scopes", &Caller{UserID: "u", Scopes: allScopes}, []string{scopeOfficesWrite}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(errorMiddleware(), func(c *gin.Context) {
+				if tt.caller != nil {
+					c.Set(callerContextKey, *tt.caller)
+				}
+			})
+			r.GET("/", requireScope(tt.required...), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotationPeriodStart(t *testing.T) {
+	loc := time.FixedZone("IST", 5*3600+1800)
+	now := time.Date(2024, 3, 15, 14, 37, 12, 0, loc)
+	tests := []struct {
+		name   string
+		period time.Duration
+		want   time.Time
+	}{
+		{"daily from local midnight", 24 * time.Hour, time.Date(2024, 3, 15, 0, 0, 0, 0, loc)},
+		{"hourly", time.Hour, time.Date(2024, 3, 15, 14, 0, 0, 0, loc)},
+		{"every six hours", 6 * time.Hour, time.Date(2024, 3, 15, 12, 0, 0, 0, loc)},
+		{"every fifteen minutes", 15 * time.Minute, time.Date(2024, 3, 15, 14, 30, 0, 0, loc)},
+		{"weekly from the epoch", 7 * 24 * time.Hour, now.Truncate(7 * 24 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rotationPeriodStart(now, tt.period); !got.Equal(tt.want) {
+				t.Errorf("rotationPeriodStart() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name     string
+		err      error
+		want     int
+		wantCode string
+	}{
+		{"bad request", badRequestError("Invalid OfficeID"), http.StatusBadRequest, "bad_request"},
+		{"unauthorized", unauthorizedError("Missing bearer token"), http.StatusUnauthorized, "unauthorized"},
+		{"forbidden", forbiddenError("Office is outside your jurisdiction"), http.StatusForbidden, "forbidden"},
+		{"not found", notFoundError("Office not found"), http.StatusNotFound, "not_found"},
+		{"validation", validationError([]FieldError{{Field: "OfficeName", Code: "required"}}), http.StatusUnprocessableEntity, "validation_failed"},
+		{"precondition failed", preconditionFailedError("stale"), http.StatusPreconditionFailed, "precondition_failed"},
+		{"precondition required", preconditionRequiredError("If-Match header is required"), http.StatusPreconditionRequired, "precondition_required"},
+		{"rate limited", rateLimitedError("Rate limit exceeded"), http.StatusTooManyRequests, "rate_limited"},
+		{"timeout", serverError(context.DeadlineExceeded, "Failed"), http.StatusGatewayTimeout, "timeout"},
+		{"plain error", errors.New("boom"), http.StatusInternalServerError, "internal_error"},
+		{"client went away", serverError(context.Canceled, "Failed"), statusClientClosedRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(errorMiddleware())
+			r.GET("/", func(c *gin.Context) {
+				c.Header("Retry-After", "1")
+				c.Error(tt.err)
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if w.Header().Get("Retry-After") != "1" {
+				t.Error("headers set before c.Error were lost")
+			}
+			if tt.wantCode == "" {
+				if w.Body.Len() != 0 {
+					t.Errorf("body = %q, want none", w.Body.String())
+				}
+				return
+			}
+			var problem Problem
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Status != tt.want || problem.Code != tt.wantCode {
+				t.Errorf("problem = %+v, want status %d code %q", problem, tt.want, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestValidGSTIN(t *testing.T) {
+	tests := []struct {
+		gstin string
+		want  bool
+	}{
+		{"27AAPFU0939F1ZV", true},
+		{"29AAGCB7383J1Z4", true},
+		{"27AAPFU0939F1ZW", false}, // wrong check character
+		{"27aapfu0939f1zv", false},
+		{"27AAPFU0939F1V", false},
+		{"27AAPFU0939F0ZV", false}, // entity code may not be 0
+		{"27AAPFU0939F1XV", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.gstin, func(t *testing.T) {
+			if got := validGSTIN(tt.gstin); got != tt.want {
+				t.Errorf("validGSTIN(%q) = %v, want %v", tt.gstin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPincodeRegexp(t *testing.T) {
+	tests := []struct {
+		pincode string
+		want    bool
+	}{
+		{"110001", true},
+		{"560034", true},
+		{"011001", false},
+		{"11001", false},
+		{"1100011", false},
+		{"11000A", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pincode, func(t *testing.T) {
+			if got := pincodeRegexp.MatchString(tt.pincode); got != tt.want {
+				t.Errorf("pincode %q matched = %v, want %v", tt.pincode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContactNumberRegexp(t *testing.T) {
+	tests := []struct {
+		number string
+		want   bool
+	}{
+		{"9876543210", true},
+		{"+919876543210", true},
+		{"+91 9876543210", true},
+		{"+91-9876543210", true},
+		{"09876543210", true},
+		{"011-23456789", true},
+		{"080 2345678", true},
+		{"5876543210", false}, // mobiles start with 6-9
+		{"987654321", false},
+		{"+19876543210", false},
+		{"98765432101", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.number, func(t *testing.T) {
+			if got := contactNumberRegexp.MatchString(tt.number); got != tt.want {
+				t.Errorf("contact number %q matched = %v, want %v", tt.number, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateOfficeDates(t *testing.T) {
+	v := validator.New()
+	v.RegisterStructValidation(validateOfficeDates, OfficeMaster{})
+
+	tests := []struct {
+		name       string
+		open       string
+		closed     string
+		wantFields map[string]string
+	}{
+		{"no dates", "", "", nil},
+		{"open only", "2020-01-15", "", nil},
+		{"closed only", "", "2020-01-15", nil},
+		{"in order", "2020-01-15", "2021-06-30", nil},
+		{"same day", "2020-01-15", "2020-01-15", nil},
+		{"RFC 3339", "2020-01-15T09:00:00+05:30", "2021-06-30T17:00:00Z", nil},
+		{"closed before open", "2021-06-30", "2020-01-15", map[string]string{"ClosedDate": "dateorder"}},
+		{"bad open date", "15/01/2020", "2021-06-30", map[string]string{"OpenToPublicDate": "date"}},
+		{"bad closed date", "2020-01-15", "2021-13-01", map[string]string{"ClosedDate": "date"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Struct(OfficeMaster{OpenToPublicDate: tt.open, ClosedDate: tt.closed})
+			got := map[string]string{}
+			var validationErrors validator.ValidationErrors
+			if errors.As(err, &validationErrors) {
+				for _, fe := range validationErrors {
+					got[fe.Field()] = fe.Tag()
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.wantFields) || (len(got) > 0 && !reflect.DeepEqual(got, tt.wantFields)) {
+				t.Errorf("errors = %v, want %v", got, tt.wantFields)
+			}
+		})
+	}
+}
+
+var registerValidatorsOnce sync.Once
+
+func setupValidators(t *testing.T) {
+	t.Helper()
+	var err error
+	registerValidatorsOnce.Do(func() { err = registerValidators() })
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRespondBindError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupValidators(t)
+
+	const valid = `"OfficeTypeID": 1, "OfficeName": "Head Post Office", "DivisionID": 1, "RegionID": 1, "CircleID": 1`
+	tests := []struct {
+		name       string
+		body       string
+		want       int
+		wantFields map[string]string
+	}{
+		{"malformed JSON", `{"OfficeName": `, http.StatusBadRequest, nil},
+		{"wrong type", `{"OfficeTypeID": "one"}`, http.StatusBadRequest, nil},
+		{"missing required", `{"OfficeTypeID": 1, "DivisionID": 1, "RegionID": 1, "CircleID": 1}`, http.StatusUnprocessableEntity,
+			map[string]string{"OfficeName": "required"}},
+		{"out of range", `{` + valid + `, "Latitude": 91}`, http.StatusUnprocessableEntity,
+			map[string]string{"Latitude": "out_of_range"}},
+		{"bad email", `{` + valid + `, "EmailID": "not-an-email"}`, http.StatusUnprocessableEntity,
+			map[string]string{"EmailID": "invalid_email"}},
+		{"bad contact number", `{` + valid + `, "ContactNumber": "12345"}`, http.StatusUnprocessableEntity,
+			map[string]string{"ContactNumber": "invalid_contact_number"}},
+		{"bad date", `{` + valid + `, "OpenToPublicDate": "yesterday"}`, http.StatusUnprocessableEntity,
+			map[string]string{"OpenToPublicDate": "invalid_date"}},
+		{"dates out of order", `{` + valid + `, "OpenToPublicDate": "2021-01-01", "ClosedDate": "2020-01-01"}`, http.StatusUnprocessableEntity,
+			map[string]string{"ClosedDate": "invalid_date_order"}},
+		{"several fields", `{"OfficeTypeID": 1, "OfficeName": "Head Post Office", "DivisionID": -1, "RegionID": 1, "CircleID": 1, "EmailID": "x"}`, http.StatusUnprocessableEntity,
+			map[string]string{"DivisionID": "out_of_range", "EmailID": "invalid_email"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(errorMiddleware())
+			r.POST("/", func(c *gin.Context) {
+				var office OfficeMaster
+				if err := c.ShouldBindJSON(&office); err != nil {
+					respondBindError(c, err)
+					return
+				}
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			var problem Problem
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, field := range problem.Fields {
+				got[field.Field] = field.Code
+			}
+			if len(got) != len(tt.wantFields) || (len(got) > 0 && !reflect.DeepEqual(got, tt.wantFields)) {
+				t.Errorf("fields = %v, want %v", got, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestReadMergePatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		body       string
+		wantErr    bool
+		wantPatch  []string
+		wantFields map[string]string
+	}{
+		{"known members", `{"OfficeName": "New", "EmailID": null}`, false, []string{"EmailID", "OfficeName"}, nil},
+		{"server managed members dropped", `{"OfficeName": "New", "UpdatedBy": "me", "CreatedDate": null}`, false, []string{"OfficeName"}, nil},
+		{"read-only members", `{"OfficeID": 7, "Status": "Closed", "ClosedDate": null}`, false, []string{"ClosedDate", "OfficeID", "Status"},
+			map[string]string{"OfficeID": "read_only", "Status": "read_only", "ClosedDate": "read_only"}},
+		{"unknown member", `{"Officename": "New"}`, false, []string{"Officename"}, map[string]string{"Officename": "unknown_field"}},
+		{"empty", `{}`, false, nil, nil},
+		{"not an object", `["OfficeName"]`, true, nil, nil},
+		{"malformed", `{"OfficeName": `, true, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(tt.body))
+
+			patch, fields, err := readMergePatch(c, OfficeMaster{}, officeReadOnlyFields)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readMergePatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var names []string
+			for name := range patch {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.wantPatch) {
+				t.Errorf("patch members = %v, want %v", names, tt.wantPatch)
+			}
+			got := map[string]string{}
+			for _, field := range fields {
+				got[field.Field] = field.Code
+			}
+			if len(got) != len(tt.wantFields) || (len(got) > 0 && !reflect.DeepEqual(got, tt.wantFields)) {
+				t.Errorf("fields = %v, want %v", got, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	current := OfficeMaster{
+		OfficeID:      7,
+		OfficeTypeID:  2,
+		OfficeName:    "Old Name",
+		EmailID:       "old@example.com",
+		ContactNumber: "9876543210",
+		DivisionID:    3,
+		Latitude:      12.5,
+	}
+	tests := []struct {
+		name  string
+		patch map[string]json.RawMessage
+		want  func(*OfficeMaster)
+	}{
+		{"empty patch keeps everything", map[string]json.RawMessage{}, func(*OfficeMaster) {}},
+		{"member replaced", map[string]json.RawMessage{"OfficeName": json.RawMessage(`"New Name"`)},
+			func(o *OfficeMaster) { o.OfficeName = "New Name" }},
+		{"null resets to zero value", map[string]json.RawMessage{"EmailID": json.RawMessage(`null`), "Latitude": json.RawMessage(`null`)},
+			func(o *OfficeMaster) { o.EmailID, o.Latitude = "", 0 }},
+		{"mixed", map[string]json.RawMessage{"DivisionID": json.RawMessage(`4`), "ContactNumber": json.RawMessage(`null`)},
+			func(o *OfficeMaster) { o.DivisionID, o.ContactNumber = 4, "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := current
+			tt.want(&want)
+
+			var got OfficeMaster
+			if err := applyMergePatch(current, tt.patch, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("applyMergePatch() = %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	var got OfficeMaster
+	if err := applyMergePatch(current, map[string]json.RawMessage{"OfficeTypeID": json.RawMessage(`"two"`)}, &got); err == nil {
+		t.Error("applyMergePatch() accepted a value of the wrong type")
+	}
+}
+
+func TestPatchUpdate(t *testing.T) {
+	merged := OfficeMaster{OfficeID: 7, OfficeName: "New Name", DivisionID: 4}
+	tests := []struct {
+		name     string
+		patch    map[string]json.RawMessage
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		{"one member", map[string]json.RawMessage{"OfficeName": json.RawMessage(`"New Name"`)},
+			"UPDATE OfficeMaster SET OfficeName = $1, UpdatedBy = $2, UpdatedDate = NOW() WHERE OfficeID = $3",
+			[]interface{}{"New Name", "clerk", 7}},
+		{"sorted members and nulls", map[string]json.RawMessage{"OfficeName": json.RawMessage(`"New Name"`), "EmailID": json.RawMessage(`null`), "DivisionID": json.RawMessage(`4`)},
+			"UPDATE OfficeMaster SET DivisionID = $1, EmailID = $2, OfficeName = $3, UpdatedBy = $4, UpdatedDate = NOW() WHERE OfficeID = $5",
+			[]interface{}{4, nil, "New Name", "clerk", 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, args, err := patchUpdate("OfficeMaster", tt.patch, merged, "clerk").Where(squirrel.Eq{"OfficeID": 7}).ToSql()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sql != tt.wantSQL {
+				t.Errorf("sql = %q, want %q", sql, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestParsePagination(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		query      string
+		wantOK     bool
+		page, size int
+	}{
+		{"", true, 1, defaultPageSize},
+		{"page=3&pageSize=20", true, 3, 20},
+		{fmt.Sprintf("page=%d&pageSize=%d", maxPage, maxPageSize), true, maxPage, maxPageSize},
+		{fmt.Sprintf("page=%d", maxPage+1), false, 0, 0},
+		{"page=9223372036854775807", false, 0, 0},
+		{"page=0", false, 0, 0},
+		{"page=-1", false, 0, 0},
+		{"page=x", false, 0, 0},
+		{"pageSize=0", false, 0, 0},
+		{fmt.Sprintf("pageSize=%d", maxPageSize+1), false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+
+			page, size, ok := parsePagination(c)
+			if ok != tt.wantOK || page != tt.page || size != tt.size {
+				t.Errorf("parsePagination() = %d, %d, %v, want %d, %d, %v", page, size, ok, tt.page, tt.size, tt.wantOK)
+			}
+			if ok && (page-1)*size > math.MaxInt32 {
+				t.Errorf("offset %d overflows an int32", (page-1)*size)
+			}
+		})
+	}
+}
+
+func TestOfficeListFiltersOrder(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const query = "officeTypeID=4&divisionID=3&regionID=2&circleID=1&status=Active&name=Head"
+	const want = "(CircleID = ? AND RegionID = ? AND DivisionID = ? AND OfficeTypeID = ? AND Status = ? AND OfficeName ILIKE ?)"
+
+	for i := 0; i < 20; i++ {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		where, err := officeListFilters(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sql, args, err := where.ToSql()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sql != want {
+			t.Fatalf("sql = %q, want %q", sql, want)
+		}
+		if !reflect.DeepEqual(args, []interface{}{1, 2, 3, 4, "Active", "Head%"}) {
+			t.Fatalf("args = %v", args)
+		}
+	}
+}
+
+// referenceRows answers the checkOfficeReferences query. Circle 1 holds region 2,
+// which holds division 3; office type 4 exists; office 10 is active and 11 is not.
+type referenceRows struct {
+	queries int
+}
+
+func (r *referenceRows) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	r.queries++
+	return referenceRow{args: args}
+}
+
+type referenceRow struct {
+	args []interface{}
+}
+
+func (r referenceRow) Scan(dest ...interface{}) error {
+	circleID, regionID, divisionID, officeTypeID := r.args[0].(int), r.args[1].(int), r.args[2].(int), r.args[3].(int)
+	reportingOfficeID := r.args[4].(int64)
+	*dest[0].(*bool) = circleID == 1
+	if regionID == 2 {
+		*dest[1].(*sql.NullInt64) = sql.NullInt64{Int64: 1, Valid: true}
+	}
+	if divisionID == 3 {
+		*dest[2].(*sql.NullInt64) = sql.NullInt64{Int64: 2, Valid: true}
+	}
+	*dest[3].(*bool) = officeTypeID == 4
+	*dest[4].(*bool) = reportingOfficeID == 10 || reportingOfficeID == 11
+	switch reportingOfficeID {
+	case 10:
+		*dest[5].(*sql.NullString) = sql.NullString{String: officeStatusActive, Valid: true}
+	case 11:
+		*dest[5].(*sql.NullString) = sql.NullString{String: officeStatusInactive, Valid: true}
+	}
+	return nil
+}
+
+func TestCheckOfficeReferences(t *testing.T) {
+	valid := OfficeMaster{OfficeID: 20, OfficeTypeID: 4, CircleID: 1, RegionID: 2, DivisionID: 3, ReportingOfficeID: 10}
+	with := func(office OfficeMaster, change func(*OfficeMaster)) OfficeMaster {
+		change(&office)
+		return office
+	}
+	// An office whose reporting office was disabled and whose division has since moved
+	stale := with(valid, func(o *OfficeMaster) { o.ReportingOfficeID, o.DivisionID = 11, 9 })
+
+	tests := []struct {
+		name        string
+		office      OfficeMaster
+		current     *OfficeMaster
+		wantFields  map[string]string
+		wantQueries int
+	}{
+		{"create valid", valid, nil, nil, 1},
+		{"create with no reporting office", with(valid, func(o *OfficeMaster) { o.ReportingOfficeID = 0 }), nil, nil, 1},
+		{"create with every reference wrong", OfficeMaster{OfficeTypeID: 5, CircleID: 7, RegionID: 8, DivisionID: 9, ReportingOfficeID: 12}, nil,
+			map[string]string{"CircleID": "not_found", "RegionID": "not_found", "DivisionID": "not_found", "OfficeTypeID": "not_found", "ReportingOfficeID": "not_found"}, 1},
+		{"create under a closed office", with(valid, func(o *OfficeMaster) { o.ReportingOfficeID = 11 }), nil,
+			map[string]string{"ReportingOfficeID": "inactive"}, 1},
+		{"create with mismatched hierarchy", with(valid, func(o *OfficeMaster) { o.CircleID = 5 }), nil,
+			map[string]string{"CircleID": "not_found", "RegionID": "hierarchy_mismatch"}, 1},
+		{"update with no reference changes", with(stale, func(o *OfficeMaster) { o.ContactNumber = "9876543210" }), &stale, nil, 0},
+		{"update to a closed reporting office", with(valid, func(o *OfficeMaster) { o.ReportingOfficeID = 11 }), &valid,
+			map[string]string{"ReportingOfficeID": "inactive"}, 1},
+		{"update away from a closed reporting office", with(stale, func(o *OfficeMaster) { o.ReportingOfficeID = 10 }), &stale, nil, 1},
+		{"update to report to itself", with(valid, func(o *OfficeMaster) { o.ReportingOfficeID = 20 }), &valid,
+			map[string]string{"ReportingOfficeID": "self_reference"}, 1},
+		{"update of the hierarchy only", with(stale, func(o *OfficeMaster) { o.DivisionID = 3 }), &stale, nil, 1},
+		{"update to a mismatched hierarchy", with(valid, func(o *OfficeMaster) { o.RegionID = 6 }), &valid,
+			map[string]string{"RegionID": "not_found", "DivisionID": "hierarchy_mismatch"}, 1},
+		{"update to an unknown office type", with(valid, func(o *OfficeMaster) { o.OfficeTypeID = 5 }), &valid,
+			map[string]string{"OfficeTypeID": "not_found"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &referenceRows{}
+			fields, err := checkOfficeReferences(context.Background(), db, tt.office, tt.current)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, field := range fields {
+				got[field.Field] = field.Code
+			}
+			if len(got) != len(tt.wantFields) || (len(got) > 0 && !reflect.DeepEqual(got, tt.wantFields)) {
+				t.Errorf("fields = %v, want %v", got, tt.wantFields)
+			}
+			if db.queries != tt.wantQueries {
+				t.Errorf("queries = %d, want %d", db.queries, tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestRecordETag(t *testing.T) {
+	office := OfficeMaster{OfficeID: 7, OfficeName: "Head Post Office"}
+	tag := recordETag(office)
+	if !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) || len(tag) != 34 {
+		t.Errorf("recordETag() = %s, want a quoted 32-digit hex tag", tag)
+	}
+	if recordETag(office) != tag {
+		t.Error("recordETag() is not stable for the same record")
+	}
+	changed := office
+	changed.OfficeName = "Head Post Office "
+	if recordETag(changed) == tag {
+		t.Error("recordETag() did not change with the record")
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	current := OfficeMaster{OfficeID: 7, OfficeName: "Head Post Office"}
+	currentTag := recordETag(current)
+	staleTag := recordETag(OfficeMaster{OfficeID: 7, OfficeName: "Old Name"})
+
+	tests := []struct {
+		name     string
+		ifMatch  string
+		want     int
+		wantETag string
+	}{
+		{"missing header", "", http.StatusPreconditionRequired, ""},
+		{"current tag", currentTag, http.StatusOK, ""},
+		{"stale tag", staleTag, http.StatusPreconditionFailed, currentTag},
+		{"unquoted tag", strings.Trim(currentTag, `"`), http.StatusPreconditionFailed, currentTag},
+		{"weak tag", "W/" + currentTag, http.StatusPreconditionFailed, currentTag},
+		{"any", "*", http.StatusOK, ""},
+		{"list with the current tag", staleTag + ", " + currentTag, http.StatusOK, ""},
+		{"list without the current tag", staleTag + `,"abc"`, http.StatusPreconditionFailed, currentTag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(errorMiddleware())
+			r.PUT("/", func(c *gin.Context) {
+				if !requireIfMatch(c) || !checkIfMatch(c, current) {
+					return
+				}
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodPut, "/", nil)
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if got := w.Header().Get("ETag"); got != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", got, tt.wantETag)
+			}
+		})
+	}
+}
+
+func TestDiffRecords(t *testing.T) {
+	type record struct {
+		ID    int      `json:"ID"`
+		Name  string   `json:"Name"`
+		Email string   `json:"Email,omitempty"`
+		Tags  []string `json:"Tags"`
+	}
+	before := record{ID: 7, Name: "Old", Email: "old@example.com", Tags: []string{"a"}}
+
+	tests := []struct {
+		name   string
+		before interface{}
+		after  interface{}
+		want   map[string]FieldChange
+	}{
+		{"no change", before, before, map[string]FieldChange{}},
+		{"both nil", nil, nil, map[string]FieldChange{}},
+		{"one field", before, record{ID: 7, Name: "New", Email: "old@example.com", Tags: []string{"a"}},
+			map[string]FieldChange{"Name": {From: "Old", To: "New"}}},
+		{"nested value", before, record{ID: 7, Name: "Old", Email: "old@example.com", Tags: []string{"a", "b"}},
+			map[string]FieldChange{"Tags": {From: []interface{}{"a"}, To: []interface{}{"a", "b"}}}},
+		{"field dropped from the JSON", before, record{ID: 7, Name: "Old", Tags: []string{"a"}},
+			map[string]FieldChange{"Email": {From: "old@example.com", To: nil}}},
+		{"field added to the JSON", record{ID: 7, Name: "Old", Tags: []string{"a"}}, before,
+			map[string]FieldChange{"Email": {From: nil, To: "old@example.com"}}},
+		{"create", nil, before, map[string]FieldChange{
+			"ID":    {From: nil, To: float64(7)},
+			"Name":  {From: nil, To: "Old"},
+			"Email": {From: nil, To: "old@example.com"},
+			"Tags":  {From: nil, To: []interface{}{"a"}},
+		}},
+		{"delete", before, nil, map[string]FieldChange{
+			"ID":    {From: float64(7), To: nil},
+			"Name":  {From: "Old", To: nil},
+			"Email": {From: "old@example.com", To: nil},
+			"Tags":  {From: []interface{}{"a"}, To: nil},
+		}},
+		{"create with a null field", nil, record{ID: 7}, map[string]FieldChange{
+			"ID":   {From: nil, To: float64(7)},
+			"Name": {From: nil, To: ""},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := diffRecords(tt.before, tt.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffRecords() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := diffRecords(nil, func() {}); err == nil {
+		t.Error("diffRecords() accepted a record that cannot be encoded")
+	}
+}
+
+func TestAuthMiddlewareRoles(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const secret = "test-secret"
+	verifier, err := newTokenVerifier(secret, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   int
+	}{
+		{"sub-division clerk only", jwt.MapClaims{"roles": []string{roleSubDivisionClerk}, "division_id": 3, "subdivision_id": 4}, http.StatusForbidden},
+		{"sub-division clerk who is also a division clerk", jwt.MapClaims{"roles": []string{roleSubDivisionClerk, roleDivisionClerk}, "division_id": 3}, http.StatusOK},
+		{"division clerk", jwt.MapClaims{"roles": []string{roleDivisionClerk}, "division_id": 3}, http.StatusOK},
+		{"no roles", jwt.MapClaims{}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.claims["sub"] = "user-1"
+			tt.claims["exp"] = time.Now().Add(time.Hour).Unix()
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, tt.claims).SignedString([]byte(secret))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := gin.New()
+			r.Use(errorMiddleware(), authMiddleware(verifier, nil))
+			r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	const shared = `
+server:
+  port: 1000
+database:
+  port: 5432
+  name: shared_db
+  sslmode: require
+log:
+  level: info
+`
+	const dev = `
+server:
+  port: 2000
+database:
+  host: devhost
+  user: dev
+  password: dev
+auth:
+  hs256_secret: dev-secret
+`
+	const prod = `
+database:
+  sslmode: verify-full
+`
+	// Every variable loadConfig reads is cleared so the outer environment cannot leak in
+	clearEnv := []string{"PROFILE", "CONFIG_DIR", "SERVER_PORT", "DATABASE_HOST", "DATABASE_PORT", "DATABASE_USER",
+		"DATABASE_PASSWORD", "DATABASE_NAME", "DATABASE_SSLMODE", "LOG_LEVEL", "LOG_FORMAT", "AUTH_HS256_SECRET", "AUTH_JWKS_FILE"}
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		wantErr string
+		check   func(t *testing.T, config *Config)
+	}{
+		{
+			name: "profile overlay over shared file over flag defaults",
+			args: []string{"--profile=dev"},
+			check: func(t *testing.T, config *Config) {
+				if config.Server.Port != 2000 || config.Database.Name != "shared_db" || config.Database.SSLMode != "require" ||
+					config.Database.Host != "devhost" || config.Log.Format != "json" {
+					t.Errorf("config = %+v", config)
+				}
+				if config.Profile != "dev" || len(config.Files) != 2 {
+					t.Errorf("profile %q, files %v", config.Profile, config.Files)
+				}
+			},
+		},
+		{
+			name: "environment over files",
+			args: []string{"--profile=dev"},
+			env:  map[string]string{"SERVER_PORT": "3000", "DATABASE_NAME": "env_db", "LOG_LEVEL": "warn"},
+			check: func(t *testing.T, config *Config) {
+				if config.Server.Port != 3000 || config.Database.Name != "env_db" || config.Log.Level != "warn" {
+					t.Errorf("config = %+v", config)
+				}
+			},
+		},
+		{
+			name: "flags over environment",
+			args: []string{"--profile=dev", "--server.port=4000", "--log.level=error"},
+			env:  map[string]string{"SERVER_PORT": "3000", "LOG_LEVEL": "warn"},
+			check: func(t *testing.T, config *Config) {
+				if config.Server.Port != 4000 || config.Log.Level != "error" {
+					t.Errorf("config = %+v", config)
+				}
+			},
+		},
+		{
+			name: "profile from the environment",
+			env:  map[string]string{"PROFILE": "dev"},
+			check: func(t *testing.T, config *Config) {
+				if config.Profile != "dev" {
+					t.Errorf("profile = %q, want dev", config.Profile)
+				}
+			},
+		},
+		{
+			name:    "missing profile",
+			wantErr: "no profile selected",
+		},
+		{
+			name:    "unknown profile",
+			args:    []string{"--profile=test"},
+			wantErr: `unknown profile "test"`,
+		},
+		{
+			name:    "missing required settings",
+			args:    []string{"--profile=prod"},
+			wantErr: "missing required settings for profile prod:\n  database.host (flag --database.host or env OFFICEAPI_DATABASE_HOST)\n  database.user",
+		},
+		{
+			name:    "missing token key",
+			args:    []string{"--profile=prod"},
+			env:     map[string]string{"DATABASE_HOST": "db", "DATABASE_USER": "u", "DATABASE_PASSWORD": "p"},
+			wantErr: "auth.hs256_secret or auth.jwks_file",
+		},
+		{
+			name: "required settings supplied by the environment",
+			args: []string{"--profile=prod"},
+			env:  map[string]string{"DATABASE_HOST": "db", "DATABASE_USER": "u", "DATABASE_PASSWORD": "p", "AUTH_JWKS_FILE": "/jwks.json"},
+			check: func(t *testing.T, config *Config) {
+				if config.Database.Host != "db" || config.Database.SSLMode != "verify-full" || config.Auth.JWKSFile != "/jwks.json" {
+					t.Errorf("config = %+v", config)
+				}
+			},
+		},
+		{
+			name:    "invalid value",
+			args:    []string{"--profile=dev", "--log.format=xml"},
+			wantErr: `invalid log.format "xml"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, body := range map[string]string{"config.yaml": shared, "config.dev.yaml": dev, "config.prod.yaml": prod} {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range clearEnv {
+				t.Setenv(envPrefix+"_"+name, "")
+			}
+			for name, value := range tt.env {
+				t.Setenv(envPrefix+"_"+name, value)
+			}
+
+			config, err := loadConfig(append([]string{"--config-dir=" + dir}, tt.args...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfig() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, config)
+		})
+	}
+}
+
+func TestLoadConfigShippedProfiles(t *testing.T) {
+	for _, name := range []string{"PROFILE", "CONFIG_DIR", "DATABASE_HOST", "DATABASE_USER", "DATABASE_PASSWORD", "AUTH_HS256_SECRET", "AUTH_JWKS_FILE"} {
+		t.Setenv(envPrefix+"_"+name, "")
+	}
+	t.Setenv(envPrefix+"_AUTH_HS256_SECRET", "test-secret")
+
+	if _, err := loadConfig([]string{"--profile=dev"}); err != nil {
+		t.Errorf("dev profile: %v", err)
+	}
+	// Staging and prod must not fall back to a database host from the shared file
+	for _, profile := range []string{"staging", "prod"} {
+		if _, err := loadConfig([]string{"--profile=" + profile}); err == nil || !strings.Contains(err.Error(), "database.host") {
+			t.Errorf("%s profile without a database host: error = %v", profile, err)
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previous := liveSettings.current.Load()
+	t.Cleanup(func() { liveSettings.current.Store(previous) })
+	liveSettings.Store(&Config{
+		Log:       LogConfig{Level: "info"},
+		RateLimit: RateLimitConfig{RequestsPerSecond: 0.001, Burst: 2, IPRequestsPerSecond: 0.001, IPBurst: 3},
+	})
+
+	const secret = "test-secret"
+	verifier, err := newTokenVerifier(secret, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(subject string) string {
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": subject, "exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + signed
+	}
+
+	r := gin.New()
+	r.Use(errorMiddleware(), ipRateLimitMiddleware(), authMiddleware(verifier, nil), rateLimitMiddleware())
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+	send := func(ip, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Rejected credentials still use up the address's bucket
+	for i := 0; i < 3; i++ {
+		if w := send("192.0.2.1", "Bearer forged"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("request %d: status = %d, want 401", i, w.Code)
+		}
+	}
+	w := send("192.0.2.1", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("flood from one address: status = %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// One caller is limited across addresses, and other callers are not affected
+	alice := token("alice")
+	for i, ip := range []string{"192.0.2.2", "192.0.2.3"} {
+		if w := send(ip, alice); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i, w.Code)
+		}
+	}
+	if w := send("192.0.2.4", alice); w.Code != http.StatusTooManyRequests {
+		t.Errorf("caller over its burst: status = %d, want 429", w.Code)
+	}
+	if w := send("192.0.2.4", token("bob")); w.Code != http.StatusOK {
+		t.Errorf("another caller: status = %d, want 200", w.Code)
+	}
+}
+
+func TestQueryLoggerLevels(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantLevel string
+	}{
+		{"no error", nil, ""},
+		{"timeout", fmt.Errorf("timeout: %w", context.DeadlineExceeded), "warn"},
+		{"client went away", fmt.Errorf("timeout: %w", context.Canceled), "info"},
+		{"failure", errors.New("relation does not exist"), "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			ctx := zerolog.New(&out).WithContext(context.Background())
+			data := map[string]interface{}{"sql": "SELECT 1"}
+			if tt.err != nil {
+				data["err"] = tt.err
+			}
+			queryLogger{}.Log(ctx, pgx.LogLevelError, "Query", data)
+
+			var entry struct {
+				Level string `json:"level"`
+			}
+			if out.Len() > 0 {
+				if err := json.Unmarshal([]byte(out.String()), &entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if entry.Level != tt.wantLevel {
+				t.Errorf("level = %q, want %q", entry.Level, tt.wantLevel)
+			}
+		})
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(requestIDMiddleware(), recoveryMiddleware())
+	r.GET("/panic", func(c *gin.Context) { panic("boom") })
+	r.GET("/panic-after-write", func(c *gin.Context) {
+		c.String(http.StatusOK, "partial")
+		panic("boom")
+	})
+
+	tests := []struct {
+		name      string
+		path      string
+		requestID string
+	}{
+		{"caller's request ID", "/panic", "report-42"},
+		{"generated request ID", "/panic", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.requestID != "" {
+				req.Header.Set(requestIDHeader, tt.requestID)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("status = %d, want 500", w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/problem+json") {
+				t.Errorf("Content-Type = %q, want application/problem+json", got)
+			}
+			var problem Problem
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			echoed := w.Header().Get(requestIDHeader)
+			if problem.CorrelationID == "" || problem.CorrelationID != echoed {
+				t.Errorf("correlation_id = %q, echoed %s = %q", problem.CorrelationID, requestIDHeader, echoed)
+			}
+			if tt.requestID != "" && echoed != tt.requestID {
+				t.Errorf("echoed %s = %q, want %q", requestIDHeader, echoed, tt.requestID)
+			}
+			if problem.Code != "internal_error" || strings.Contains(w.Body.String(), "boom") {
+				t.Errorf("body = %s, want an internal_error without the panic value", w.Body.String())
+			}
+		})
+	}
+
+	t.Run("after the response started", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic-after-write", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "partial" {
+			t.Errorf("status = %d, body = %q, want the partial response untouched", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	longest := strings.Repeat("a", 52)
+	if got := len(applicationName + "/" + longest); got > maxApplicationNameLen {
+		t.Fatalf("a %d-character request ID makes an application_name of %d bytes", len(longest), got)
+	}
+
+	tests := []struct {
+		name     string
+		incoming string
+		wantKept bool
+	}{
+		{"none", "", false},
+		{"valid", "req-1.2:3_X", true},
+		{"longest accepted", longest, true},
+		{"too long for application_name", longest + "a", false},
+		{"space", "req 1", false},
+		{"newline", "req\n1", false},
+		{"quote", `req"1`, false},
+		{"non-ASCII", "réq", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen, seenOnContext string
+			r := gin.New()
+			r.Use(requestIDMiddleware())
+			r.GET("/", func(c *gin.Context) {
+				seen = requestID(c)
+				seenOnContext, _ = c.Request.Context().Value(requestIDKey{}).(string)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(requestIDHeader, tt.incoming)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			echoed := w.Header().Get(requestIDHeader)
+			if echoed != seen || seenOnContext != seen {
+				t.Errorf("echoed %q, handler saw %q, context holds %q", echoed, seen, seenOnContext)
+			}
+			if tt.wantKept && echoed != tt.incoming {
+				t.Errorf("echoed %q, want the caller's %q", echoed, tt.incoming)
+			}
+			if !tt.wantKept && (echoed == tt.incoming || !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(echoed)) {
+				t.Errorf("echoed %q, want a generated ID", echoed)
+			}
+		})
+	}
+}
+
+func TestQueryName(t *testing.T) {
+	count, _, err := psql.Select("COUNT(*)").From("OfficeMaster").Where(squirrel.And{squirrel.Eq{"CircleID": 1}}).ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, _, err := psql.Select(officeColumns).From("OfficeMaster").Where(squirrel.Eq{"RegionID": 2}).
+		OrderBy("OfficeName ASC").Limit(50).Offset(100).ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, _, err := patchUpdate("OfficeMaster", map[string]json.RawMessage{"OfficeName": json.RawMessage(`"x"`)}, OfficeMaster{}, "clerk").
+		Where(squirrel.Eq{"OfficeID": 7}).Suffix("RETURNING " + officeColumns).ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		sql  string
+		want string
+	}{
+		{"squirrel count", count, "select officemaster"},
+		{"squirrel list", list, "select officemaster"},
+		{"squirrel update", patch, "update officemaster"},
+		{"multi-line select", "\n\t\tSELECT " + officeColumns + "\n\t\tFROM OfficeMaster WHERE OfficeID = $1 FOR UPDATE", "select officemaster"},
+		{"subquery in FROM", "SELECT COUNT(*) FROM (SELECT OfficeID FROM OfficeMaster WHERE CircleID = $1) AS matching", "select officemaster"},
+		{"subquery closing on the table", "SELECT * FROM (SELECT * FROM OfficeAuditLog) a", "select officeauditlog"},
+		{"insert", "INSERT INTO OfficeAuditLog (EntityType, EntityID) VALUES ($1, $2)", "insert officeauditlog"},
+		{"insert returning", "\n\t\t\tINSERT INTO OfficeMaster (\n\t\t\t\tOfficeTypeID\n\t\t\t) VALUES ($1) RETURNING OfficeID", "insert officemaster"},
+		{"update", "UPDATE ApiKeys SET LastUsedAt = NOW() WHERE KeyID = $1", "update apikeys"},
+		{"update with a subquery", "UPDATE OfficeMaster SET Status = (SELECT Status FROM OfficeStatus LIMIT 1)", "update officemaster"},
+		{"delete", "DELETE FROM OfficeAttributeMaster WHERE AttributeID = $1;", "delete officeattributemaster"},
+		{"no table", "SELECT set_config('application_name', $1, false)", "select"},
+		{"lower case", "select 1 from officetypemaster", "select officetypemaster"},
+		{"verb only", "BEGIN", "begin"},
+		{"empty", "  ", "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queryName(tt.sql); got != tt.want {
+				t.Errorf("queryName(%q) = %q, want %q", tt.sql, got, tt.want)
+			}
+		})
+	}
+}
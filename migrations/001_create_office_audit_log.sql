@@ -0,0 +1,19 @@
+-- OfficeAuditLog records every change made to an office or its attributes through
+-- the API. Rows are only ever inserted; the history endpoint reads them back.
+BEGIN;
+
+CREATE TABLE OfficeAuditLog (
+	AuditID    BIGSERIAL PRIMARY KEY,
+	EntityType TEXT        NOT NULL,
+	EntityID   BIGINT      NOT NULL,
+	OfficeID   BIGINT      NOT NULL,
+	Action     TEXT        NOT NULL,
+	Actor      TEXT        NOT NULL,
+	RequestID  TEXT,
+	ChangedAt  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	Changes    JSONB       NOT NULL
+);
+
+CREATE INDEX OfficeAuditLog_OfficeID_idx ON OfficeAuditLog (OfficeID, ChangedAt DESC);
+
+COMMIT;
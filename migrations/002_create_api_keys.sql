@@ -0,0 +1,19 @@
+-- ApiKeys holds the scoped keys issued to machine-to-machine callers. Only the
+-- SHA-256 hash of each key is stored.
+BEGIN;
+
+CREATE TABLE ApiKeys (
+	KeyID      BIGSERIAL PRIMARY KEY,
+	Name       TEXT        NOT NULL UNIQUE,
+	KeyPrefix  TEXT        NOT NULL,
+	KeyHash    TEXT        NOT NULL UNIQUE,
+	Scopes     TEXT[]      NOT NULL,
+	ExpiresAt  TIMESTAMPTZ,
+	CreatedBy  TEXT        NOT NULL,
+	CreatedAt  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	LastUsedAt TIMESTAMPTZ,
+	RevokedBy  TEXT,
+	RevokedAt  TIMESTAMPTZ
+);
+
+COMMIT;